@@ -0,0 +1,229 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jwkohnen/prometheus_fileage_exporter/exporter"
+)
+
+// benchFilesPerDir is how many files the bench subcommand puts in each
+// directory of the generated tree.
+const benchFilesPerDir = 1000
+
+// bench implements the bench subcommand. It generates a tree of synthetic
+// files, watches it like -file-end-recursive does, touches random files at a
+// fixed rate and reports how long it took until each change showed up in
+// the metrics, which changes never did, and the memory used. It returns the
+// process exit code: 0 on success, 1 on errors and 2 on usage errors.
+func bench(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(out)
+	files := fs.Int("files", 10000, "number of files to generate")
+	rate := fs.Float64("rate", 100, "file changes per second")
+	duration := fs.Duration("duration", 10*time.Second, "how long to change files")
+	dir := fs.String("dir", "", "directory to generate the files in, on the file system to size for; a temporary directory if empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *files <= 0 || *rate <= 0 || *duration <= 0 || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	root, err := os.MkdirTemp(*dir, "fileage-bench-")
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "FAIL creating directory: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(root)
+
+	began := time.Now()
+	paths, err := benchTree(root, *files)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "FAIL generating files: %v\n", err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(out, "files: %d in %d directories, generated in %s\n",
+		len(paths), (len(paths)+benchFilesPerDir-1)/benchFilesPerDir, time.Since(began).Round(time.Millisecond))
+	resolution, err := benchMtimeResolution(root)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "FAIL detecting the mtime resolution: %v\n", err)
+		return 1
+	}
+	_, _ = fmt.Fprintf(out, "mtime resolution: %s\n", resolution)
+
+	// Changes are told apart by their mtime as the file system stores it.
+	// Of several changes within the same mtime only the first one can make
+	// a file the newest, so that is the one timed.
+	var (
+		mu        sync.Mutex
+		sent      = make(map[int64]time.Time) // by mtime truncated to resolution
+		latencies []time.Duration
+	)
+	sink := exporter.SinkFunc(func(n exporter.Notification) {
+		if n.Kind != exporter.RunFinished {
+			return
+		}
+		key := n.End.Truncate(resolution).UnixNano()
+		mu.Lock()
+		defer mu.Unlock()
+		if at, ok := sent[key]; ok {
+			latencies = append(latencies, time.Since(at))
+			delete(sent, key)
+		}
+	})
+	began = time.Now()
+	x, err := exporter.NewWithLogger(&exporter.Config{
+		Job: exporter.Job{
+			EndFile:      root,
+			EndRecursive: true,
+		},
+		DirectoryTimeout: time.Second,
+		Registerer:       prometheus.NewRegistry(),
+		Sinks:            []exporter.Sink{sink},
+	}, log.New(out, "", log.LstdFlags))
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "FAIL starting the exporter: %v\n", err)
+		return 1
+	}
+	defer x.Close()
+	_, _ = fmt.Fprintf(out, "watching: set up in %s\n", time.Since(began).Round(time.Millisecond))
+
+	var peak runtime.MemStats
+	tick := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer tick.Stop()
+	var changes int
+	var sampled time.Time
+	began = time.Now()
+	for deadline := began.Add(*duration); time.Now().Before(deadline); changes++ {
+		<-tick.C
+		now := time.Now()
+		key := now.Truncate(resolution).UnixNano()
+		mu.Lock()
+		if _, ok := sent[key]; !ok {
+			sent[key] = now
+		}
+		mu.Unlock()
+		if err := os.Chtimes(paths[rand.Intn(len(paths))], now, now); err != nil {
+			_, _ = fmt.Fprintf(out, "FAIL changing a file: %v\n", err)
+			return 1
+		}
+		if now.Sub(sampled) >= time.Second {
+			benchPeakMem(&peak)
+			sampled = now
+		}
+	}
+	elapsed := time.Since(began)
+	// Give the last changes a chance to arrive.
+	time.Sleep(time.Second)
+	benchPeakMem(&peak)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The ticker drops ticks if changing files falls behind. Unmatched
+	// changes were coalesced with others, shared their mtime or got lost.
+	_, _ = fmt.Fprintf(out, "changes: %d at %.1f/s of %g/s, %d seen, %d unmatched\n",
+		changes, float64(changes)/elapsed.Seconds(), *rate, len(latencies), changes-len(latencies))
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, k int) bool { return latencies[i] < latencies[k] })
+		q := func(p float64) time.Duration {
+			return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+		}
+		_, _ = fmt.Fprintf(out, "latency: p50 %s, p90 %s, p99 %s, max %s\n", q(0.5), q(0.9), q(0.99), q(1))
+	}
+	_, _ = fmt.Fprintf(out, "memory: peak heap %.1f MiB, peak sys %.1f MiB, %d goroutines\n",
+		float64(peak.HeapAlloc)/(1<<20), float64(peak.Sys)/(1<<20), runtime.NumGoroutine())
+	return 0
+}
+
+// benchTree creates n empty files beneath root, benchFilesPerDir per
+// directory, and returns their paths.
+func benchTree(root string, n int) ([]string, error) {
+	paths := make([]string, 0, n)
+	var dir string
+	for i := 0; i < n; i++ {
+		if i%benchFilesPerDir == 0 {
+			dir = filepath.Join(root, fmt.Sprintf("d%04d", i/benchFilesPerDir))
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				return nil, err
+			}
+		}
+		p := filepath.Join(dir, fmt.Sprintf("f%04d", i%benchFilesPerDir))
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// benchMtimeResolutions are the mtime resolutions of common file systems,
+// finest first: e.g. ext4 and XFS, NTFS, exFAT, ext3 and HFS+, FAT.
+var benchMtimeResolutions = []time.Duration{
+	time.Nanosecond, 100 * time.Nanosecond, time.Microsecond, time.Millisecond,
+	10 * time.Millisecond, time.Second, 2 * time.Second,
+}
+
+// benchMtimeResolution returns the resolution the file system of dir
+// stores mtimes with, by setting the mtime of a scratch file.
+func benchMtimeResolution(dir string) (time.Duration, error) {
+	f, err := os.CreateTemp(dir, ".resolution-")
+	if err != nil {
+		return 0, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	// Odd seconds and all digits of the nanoseconds set.
+	set := time.Unix(1_000_000_001, 123_456_789)
+	if err := os.Chtimes(f.Name(), set, set); err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range benchMtimeResolutions {
+		if fi.ModTime().Equal(set.Truncate(r)) {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("mtime %s stored as %s", set, fi.ModTime())
+}
+
+// benchPeakMem keeps the highest memory usage seen in peak.
+func benchPeakMem(peak *runtime.MemStats) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > peak.HeapAlloc {
+		peak.HeapAlloc = m.HeapAlloc
+	}
+	if m.Sys > peak.Sys {
+		peak.Sys = m.Sys
+	}
+}
@@ -0,0 +1,117 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// acknowledge treats the job as fresh as of now, e.g. because the data has
+// been delivered out-of-band, without touching any files. The next regular
+// update run supersedes it.
+func (j *job) acknowledge(by, reason string) time.Time {
+	j.accountSLO()
+	now := j.x.now()
+	j.mu.Lock()
+	j.acked = now
+	j.mu.Unlock()
+
+	j.promAcknowledged.Reset()
+	j.promAcknowledged.WithLabelValues(by, reason).Set(1)
+	j.promAcknowledgedTime.Set(float64(now.UnixNano()) / 1e9)
+	j.setState(j.state())
+	j.checkState()
+	j.x.log.Printf("%sAcknowledged as fresh by %s: %s", j.prefix(), by, reason)
+	return now
+}
+
+// snooze excludes the job from health aggregation and notifications until d
+// from now. A d of 0 ends a snooze. It returns the end of the snooze.
+func (j *job) snooze(by, reason string, d time.Duration) time.Time {
+	until := j.x.now().Add(d)
+	j.mu.Lock()
+	j.snoozedUntil = until
+	j.mu.Unlock()
+	if d > 0 {
+		j.x.log.Printf("%sSnoozed until %s by %s: %s", j.prefix(), until.Format(time.RFC3339), by, reason)
+	} else {
+		j.x.log.Printf("%sSnooze ended by %s: %s", j.prefix(), by, reason)
+	}
+	return until
+}
+
+// snoozed returns the end of the snooze and whether it is still active.
+func (j *job) snoozed() (time.Time, bool) {
+	j.mu.RLock()
+	until := j.snoozedUntil
+	j.mu.RUnlock()
+	return until, until.After(j.x.now())
+}
+
+// ackHandler acknowledges the job given by the form value "job", which is
+// empty for the job configured by flags, on behalf of the authenticated
+// user. The form value "reason" is recorded along with it.
+func (x *Exporter) ackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	by, _, _ := r.BasicAuth()
+	name, reason := r.FormValue("job"), r.FormValue("reason")
+	for _, j := range x.currentJobs() {
+		if j.c.Name != name {
+			continue
+		}
+		at := j.acknowledge(by, reason)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = fmt.Fprintf(w, "ack: %s treated as fresh as of %s by %s\r\n", j.endFile, at.Format(time.RFC3339Nano), by)
+		return
+	}
+	http.Error(w, fmt.Sprintf("ack: no job %q", name), http.StatusNotFound)
+}
+
+// snoozeHandler snoozes the job given by the form value "job" for the form
+// value "duration" on behalf of the authenticated user, see ackHandler.
+func (x *Exporter) snoozeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil || d < 0 {
+		http.Error(w, fmt.Sprintf("snooze: invalid duration %q", r.FormValue("duration")), http.StatusBadRequest)
+		return
+	}
+	by, _, _ := r.BasicAuth()
+	name, reason := r.FormValue("job"), r.FormValue("reason")
+	for _, j := range x.currentJobs() {
+		if j.c.Name != name {
+			continue
+		}
+		until := j.snooze(by, reason, d)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if d > 0 {
+			_, _ = fmt.Fprintf(w, "snooze: %s snoozed until %s by %s\r\n", j.endFile, until.Format(time.RFC3339Nano), by)
+		} else {
+			_, _ = fmt.Fprintf(w, "snooze: %s no longer snoozed by %s\r\n", j.endFile, by)
+		}
+		return
+	}
+	http.Error(w, fmt.Sprintf("snooze: no job %q", name), http.StatusNotFound)
+}
@@ -0,0 +1,122 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Endpoint names for Config.BasicAuthEndpoints.
+var authEndpoints = []string{"prom", "health", "liveness", "readiness", "startup", "reload", "selftest", "stat", "probe"}
+
+// basicAuth checks HTTP basic auth credentials against bcrypt hashes.
+type basicAuth struct {
+	users     map[string][]byte
+	endpoints map[string]bool
+}
+
+// dummyHash is compared against for unknown users, so that response times
+// don't tell which users exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// newBasicAuth reads users from file, one "user:bcrypt-hash" per line as
+// written by "htpasswd -B", and protects the named endpoints, a comma
+// separated list of authEndpoints.
+func newBasicAuth(file, endpoints string) (*basicAuth, error) {
+	a := &basicAuth{
+		users:     make(map[string][]byte),
+		endpoints: make(map[string]bool),
+	}
+	for _, name := range strings.Split(endpoints, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, e := range authEndpoints {
+			known = known || e == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown endpoint %q for basic auth, must be one of %s", name, strings.Join(authEndpoints, ","))
+		}
+		a.endpoints[name] = true
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", file, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %q: %w", file, line, user, err)
+		}
+		a.users[user] = []byte(hash)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(a.users) == 0 {
+		return nil, fmt.Errorf("%s: no users", file)
+	}
+	return a, nil
+}
+
+// wrap requires valid credentials for handler if the endpoint is protected.
+func (a *basicAuth) wrap(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	if a == nil || !a.endpoints[endpoint] {
+		return handler
+	}
+	return a.require(handler)
+}
+
+// require requires valid credentials for handler.
+func (a *basicAuth) require(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fileage_exporter", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (a *basicAuth) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, known := a.users[user]
+	if !known {
+		hash = dummyHash
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && known
+}
@@ -0,0 +1,72 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+//go:build chaos
+
+package exporter
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Built with the chaos tag, faults can be injected into the pipeline to
+// verify alerting for failure modes that are hard to reproduce naturally.
+// They are configured by environment variables:
+//
+//	FILEAGE_CHAOS_STAT_ERRORS  fraction of stat calls that fail, e.g. 0.1
+//	FILEAGE_CHAOS_EVENT_DELAY  delay before an fs event is processed
+//	FILEAGE_CHAOS_CLOCK_SKEW   offset added to the exporter's clock
+var (
+	chaosStatErrors float64
+	chaosEventDelay time.Duration
+	chaosClockSkew  time.Duration
+)
+
+var errChaos = errors.New("injected stat error")
+
+func init() {
+	var err error
+	if v, ok := os.LookupEnv("FILEAGE_CHAOS_STAT_ERRORS"); ok {
+		if chaosStatErrors, err = strconv.ParseFloat(v, 64); err != nil {
+			log.Fatalf("Invalid FILEAGE_CHAOS_STAT_ERRORS: %v", err)
+		}
+	}
+	if v, ok := os.LookupEnv("FILEAGE_CHAOS_EVENT_DELAY"); ok {
+		if chaosEventDelay, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("Invalid FILEAGE_CHAOS_EVENT_DELAY: %v", err)
+		}
+	}
+	if v, ok := os.LookupEnv("FILEAGE_CHAOS_CLOCK_SKEW"); ok {
+		if chaosClockSkew, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("Invalid FILEAGE_CHAOS_CLOCK_SKEW: %v", err)
+		}
+	}
+	log.Printf("Chaos build: stat errors %g, event delay %s, clock skew %s", chaosStatErrors, chaosEventDelay, chaosClockSkew)
+}
+
+func now() time.Time { return time.Now().Add(chaosClockSkew) }
+
+func stat(name string) (os.FileInfo, error) {
+	if chaosStatErrors > 0 && rand.Float64() < chaosStatErrors {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: errChaos}
+	}
+	return os.Stat(name)
+}
+
+func delayEvent() { time.Sleep(chaosEventDelay) }
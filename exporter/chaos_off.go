@@ -0,0 +1,31 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+//go:build !chaos
+
+package exporter
+
+import (
+	"os"
+	"time"
+)
+
+// Without the chaos build tag the fault injection hooks of chaos.go are
+// plain calls to the standard library.
+
+func now() time.Time { return time.Now() }
+
+func stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func delayEvent() {}
@@ -0,0 +1,208 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Time sources ages are computed against, see Config.TimeSource.
+const (
+	// TimeSourceSystem is the system clock.
+	TimeSourceSystem = "system"
+	// TimeSourceMonotonic is the system clock at startup advanced by the
+	// monotonic clock, which is immune to jumps of the system clock.
+	TimeSourceMonotonic = "monotonic"
+	// TimeSourceNTP is the system clock corrected by its offset to an NTP
+	// server, which is checked every Config.NTPInterval.
+	TimeSourceNTP = "ntp"
+)
+
+// ntpTimeout limits each NTP query.
+const ntpTimeout = 5 * time.Second
+
+// validateTimeSource checks the time source settings of c.
+func (c *Config) validateTimeSource() error {
+	switch c.TimeSource {
+	case "", TimeSourceSystem, TimeSourceMonotonic:
+	case TimeSourceNTP:
+		if c.NTPServer == "" {
+			return errors.New("the ntp time source needs an NTP server")
+		}
+	default:
+		return fmt.Errorf("unknown time source %q", c.TimeSource)
+	}
+	return nil
+}
+
+// referenceClock returns the clock of the configured time source along with
+// a function that stops it.
+func (x *Exporter) referenceClock() (clock func() time.Time, stop func()) {
+	switch x.c.TimeSource {
+	case TimeSourceMonotonic:
+		started := now()
+		return func() time.Time { return started.Add(time.Since(started)) }, func() {}
+	case TimeSourceNTP:
+		c := newNTPClock(x)
+		return c.now, c.close
+	default:
+		return now, func() {}
+	}
+}
+
+// newClockOffset returns the fileage_exporter_clock_offset_seconds metric.
+func (x *Exporter) newClockOffset() prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "fileage_exporter_clock_offset_seconds",
+		Help: "Offset of the clock that ages are computed against to the system clock.",
+	}, func() float64 {
+		return x.now().Sub(now()).Seconds()
+	})
+}
+
+// ntpClock is the system clock corrected by its offset to an NTP server.
+type ntpClock struct {
+	mu     sync.RWMutex
+	offset time.Duration
+
+	done chan struct{}
+	loop sync.WaitGroup
+}
+
+func newNTPClock(x *Exporter) *ntpClock {
+	c := &ntpClock{done: make(chan struct{})}
+	errs := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fileage_exporter_clock_sync_errors_total",
+		Help: "Counter of failed queries of the NTP server.",
+	})
+	x.register(errs)
+	interval := x.c.NTPInterval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	query := func() {
+		offset, err := sntpOffset(x.c.NTPServer)
+		if err != nil {
+			errs.Inc()
+			x.log.Printf("Error querying NTP server %s, keeping offset %s: %v", x.c.NTPServer, c.get(), err)
+			return
+		}
+		c.mu.Lock()
+		c.offset = offset
+		c.mu.Unlock()
+	}
+	// The offset is zero until the first query answers, which doesn't hold
+	// up New for as long as ntpTimeout.
+	c.loop.Add(1)
+	go func() {
+		defer c.loop.Done()
+		query()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-tick.C:
+				query()
+			}
+		}
+	}()
+	return c
+}
+
+func (c *ntpClock) get() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.offset
+}
+
+func (c *ntpClock) now() time.Time {
+	return now().Add(c.get())
+}
+
+func (c *ntpClock) close() {
+	close(c.done)
+	c.loop.Wait()
+}
+
+// ntpEpoch is the NTP era 0 epoch, 1900-01-01.
+var ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// sntpOffset queries server as an SNTP client (RFC 4330) and returns the
+// offset of the server's clock to the system clock.
+func sntpOffset(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, ntpTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(ntpTimeout)); err != nil {
+		return 0, err
+	}
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // leap indicator 0, version 4, mode 3 (client)
+	t1 := now()
+	binary.BigEndian.PutUint64(req[40:], ntpTimestamp(t1))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	t4 := now()
+	if n < 48 {
+		return 0, fmt.Errorf("short NTP response of %d bytes", n)
+	}
+	if mode := resp[0] & 0x7; mode != 4 {
+		return 0, fmt.Errorf("unexpected NTP mode %d", mode)
+	}
+	if stratum := resp[1]; stratum == 0 || stratum > 15 {
+		return 0, fmt.Errorf("NTP server is unsynchronized (stratum %d)", stratum)
+	}
+	if binary.BigEndian.Uint64(resp[24:]) != ntpTimestamp(t1) {
+		return 0, errors.New("NTP response does not match the request")
+	}
+	t2 := ntpTime(binary.BigEndian.Uint64(resp[32:]))
+	t3 := ntpTime(binary.BigEndian.Uint64(resp[40:]))
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+// ntpTimestamp converts t to the 64 bit NTP timestamp format.
+func ntpTimestamp(t time.Time) uint64 {
+	d := t.Sub(ntpEpoch)
+	sec := uint64(d / time.Second)
+	frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// ntpTime converts a 64 bit NTP timestamp to time.Time.
+func ntpTime(ts uint64) time.Time {
+	sec, frac := ts>>32, ts&0xffffffff
+	return ntpEpoch.Add(time.Duration(sec)*time.Second + time.Duration(frac*uint64(time.Second)>>32))
+}
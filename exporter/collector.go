@@ -0,0 +1,100 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeCollector collects the metrics of a job that depend on the current
+// time, refreshing them at scrape time. This keeps them fresh for any
+// gatherer of the registry, not only the exporter's own handler.
+type scrapeCollector struct {
+	j  *job
+	cs []prometheus.Collector
+}
+
+func newScrapeCollector(j *job) *scrapeCollector {
+	c := &scrapeCollector{
+		j:  j,
+		cs: []prometheus.Collector{j.promUpdateState, j.promWelpenschutzRemaining, j.promSnoozed, j.slo.promObserved, j.slo.promStale},
+	}
+	if j.promPhaseCompleted != nil {
+		c.cs = append(c.cs, j.promPhaseCompleted, j.promPhaseDuration)
+	}
+	if j.c.StartFile != "" {
+		c.cs = append(c.cs, j.promRunElapsed)
+	}
+	return c
+}
+
+func (c *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.j.promUpdateAge.Describe(ch)
+	c.j.promLastRunEnd.Describe(ch)
+	if c.j.c.StartFile != "" {
+		c.j.promLastRunStart.Describe(ch)
+		c.j.promLastDuration.Describe(ch)
+	}
+	for _, m := range c.cs {
+		m.Describe(ch)
+	}
+}
+
+func (c *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	j := c.j
+	j.mu.RLock()
+	myEnd := j.end
+	elapsed, _ := j.runElapsed()
+	ran, startKnown, durationSet := !j.countedEnd.IsZero(), !j.lastRunStart.IsZero(), j.durationSet
+	j.mu.RUnlock()
+
+	// update_age is only exported once the end file has been seen, as any
+	// initial value would look like a fresh update. Likewise the last run
+	// is only exported once there has been one.
+	if !myEnd.IsZero() {
+		j.promUpdateAge.Set(j.x.since(myEnd).Seconds())
+		j.promUpdateAge.Collect(ch)
+	}
+	if ran {
+		j.promLastRunEnd.Collect(ch)
+	}
+	if j.c.StartFile != "" {
+		if startKnown {
+			j.promLastRunStart.Collect(ch)
+		}
+		if durationSet {
+			j.promLastDuration.Collect(ch)
+		}
+	}
+	j.promRunElapsed.Set(elapsed.Seconds())
+	j.setState(j.state())
+	j.accountSLO()
+	j.collectPhases()
+	if remaining := j.welpenschutzRemaining(); remaining == welpenschutzOpen {
+		j.promWelpenschutzRemaining.Set(math.Inf(1))
+	} else {
+		j.promWelpenschutzRemaining.Set(remaining.Seconds())
+	}
+	if _, snoozed := j.snoozed(); snoozed {
+		j.promSnoozed.Set(1)
+	} else {
+		j.promSnoozed.Set(0)
+	}
+	for _, m := range c.cs {
+		m.Collect(ch)
+	}
+}
@@ -14,21 +14,508 @@
 
 package exporter
 
-import "time"
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// Values for Job.WelpenschutzMode.
+const (
+	// WelpenschutzDuration keeps the service healthy for Welpenschutz after
+	// startup. This is the default.
+	WelpenschutzDuration = "duration"
+	// WelpenschutzUntilUpdate keeps the service healthy until the first
+	// update run has been observed.
+	WelpenschutzUntilUpdate = "update"
+	// WelpenschutzUntilExists keeps the service healthy until the end file
+	// has been seen for the first time.
+	WelpenschutzUntilExists = "exists"
+	// WelpenschutzIfMissing keeps the service healthy for Welpenschutz after
+	// startup only if the end file has never existed. An end file that
+	// exists at startup is judged by its age right away, so a restart
+	// doesn't hide a stale end file.
+	WelpenschutzIfMissing = "missing"
+)
+
+// Values for Job.DurationSource.
+const (
+	// DurationMtime measures update runs from the mtime of the start file
+	// to the mtime of the end file. This is the default.
+	DurationMtime = "mtime"
+	// DurationEvents measures update runs from when the exporter observed
+	// the start file change to when it observed the end file change, for
+	// tools that don't set reliable mtimes, e.g. because they copy files
+	// preserving their mtimes.
+	DurationEvents = "events"
+)
+
+// Values for Job.DirectoryRemoved.
+const (
+	// DirectoryRemovedError reports a job whose watched directory vanished
+	// as unhealthy with state unknown, as its files can't be read. This is
+	// the default.
+	DirectoryRemovedError = "error"
+	// DirectoryRemovedStale reports a job whose watched directory vanished
+	// as unhealthy with state stale, for alerts that only look at
+	// staleness.
+	DirectoryRemovedStale = "stale"
+)
+
+// Values for Config.LivenessMode.
+const (
+	// LivenessStaleness reports un-live if the end file is older than the
+	// liveness timeout. This is the default.
+	LivenessStaleness = "staleness"
+	// LivenessInternal reports un-live only if the exporter itself is
+	// broken, i.e. a watch loop stalled, leaving staleness to the health
+	// check.
+	LivenessInternal = "internal"
+)
+
+// Values for Config.HealthAggregate.
+const (
+	// HealthAggregateAny reports unhealthy if any job is unhealthy. This is
+	// the default.
+	HealthAggregateAny = "any"
+	// HealthAggregateAll reports unhealthy only if all jobs are unhealthy.
+	HealthAggregateAll = "all"
+)
+
+// Values for ProbeModule.Timestamp.
+const (
+	// TimestampMtime computes ages from the modification time. This is the
+	// default.
+	TimestampMtime = "mtime"
+	// TimestampCtime computes ages from the inode change time, which also
+	// moves on chmod, chown and renames. It is not available on Windows.
+	TimestampCtime = "ctime"
+)
+
+// Values for ProbeModule.Glob.
+const (
+	// GlobNone takes the target literally. This is the default.
+	GlobNone = "none"
+	// GlobNewest expands the target as a glob pattern and checks the newest
+	// match, so any fresh match succeeds.
+	GlobNewest = "newest"
+	// GlobOldest expands the target as a glob pattern and checks the oldest
+	// match, so all matches have to be fresh.
+	GlobOldest = "oldest"
+)
 
 type Config struct {
-	StartFile        string
-	EndFile          string
+	// Job is the job configured by flags. Its settings are the defaults
+	// for Jobs. It is monitored only if Jobs is empty.
+	Job
+	// Jobs are the jobs from a config file.
+	Jobs []Job
+	// ConfigFile is read for Jobs at startup and by Exporter.Reload.
+	ConfigFile string
+
 	Listen           string
+	DrainTimeout     time.Duration
 	PromEndpoint     string
 	HealthEndpoint   string
 	LivenessEndpoint string
-	HealthTimeout    time.Duration
-	LivenessTimeout  time.Duration
-	Welpenschutz     time.Duration
-	DirectoryTimeout time.Duration
-	Namespace        string
-	Subsystem        string
-	LogJSON          bool
-	Debug            bool
+	// ReadinessEndpoint reports ready once all directories are watched and
+	// the files have been measured, regardless of their age.
+	ReadinessEndpoint string
+	// MetricsRequireReady makes the metrics endpoint answer 503 until the
+	// files of all jobs have been measured for the first time, so the zero
+	// counts of a large tree that is still being walked aren't recorded.
+	MetricsRequireReady bool
+	// StartupEndpoint reports started once the end files of all jobs have
+	// been found, and stays so for good.
+	StartupEndpoint string
+	LivenessMode    string
+	// HealthAggregate tells how the health of several jobs adds up, one of
+	// the HealthAggregate constants.
+	HealthAggregate string
+	// HealthFailureStatus is the status code of failed health and liveness
+	// checks, 503 if zero. HealthRetryAfter is sent as Retry-After with
+	// them if the next update of a failed job can't be estimated, none if
+	// zero.
+	HealthFailureStatus int
+	HealthRetryAfter    time.Duration
+	ReloadEndpoint      string
+	AckEndpoint         string
+	SnoozeEndpoint      string
+	SelftestEndpoint    string
+	SelftestDir         string
+	StatEndpoint        string
+	// TenantEndpoint is the path below which the metrics of each tenant are
+	// served, as TenantEndpoint + name + "/metrics".
+	TenantEndpoint string
+	// ProbeEndpoint serves metrics about a file given by query parameter,
+	// if StatRoots is set.
+	ProbeEndpoint string
+	// StatRoots is a comma separated list of directories the stat API may
+	// look into. The stat API is disabled if it is empty.
+	StatRoots  string
+	GRPCHealth bool
+	// EchoParams is a comma separated list of query parameters of scrapes
+	// that are added as labels to all series of the scrape.
+	EchoParams string
+	// BasicAuthFile holds "user:bcrypt-hash" lines. If set, the endpoints
+	// in BasicAuthEndpoints require HTTP basic auth.
+	BasicAuthFile      string
+	BasicAuthEndpoints string
+	HealthTemplate     string
+	DirectoryTimeout   time.Duration
+	DirectoryRetry     RetryPolicy
+	// AllowMissingTargets starts jobs whose directories are missing instead
+	// of giving up after DirectoryTimeout. They are watched once they appear.
+	AllowMissingTargets bool
+	// PollInterval, if set, watches the directories of the jobs by listing
+	// them this often instead of by fs notifications.
+	PollInterval time.Duration
+	// LowResource trims the memory of the exporter for small devices: the
+	// update_duration_seconds summary keeps fewer samples, and tree stats
+	// list at most lowResourceTopFiles files of Job.TopFiles.
+	LowResource bool
+	// DurationObjectives are the quantiles of the update_duration_seconds
+	// summary, computed over a sliding window of DurationMaxAge, which
+	// defaults to 10 minutes.
+	DurationObjectives Objectives
+	DurationMaxAge     time.Duration
+	// DurationHistogram exports update_duration_seconds as a histogram
+	// with DurationBuckets, or exponential buckets from 1s to about 36h,
+	// instead of a summary. A positive DurationNativeFactor also exports
+	// it as a native histogram with this growth factor between buckets.
+	DurationHistogram    bool
+	DurationBuckets      Buckets
+	DurationNativeFactor float64
+	// StateFile persists counters and the last run of each job across
+	// restarts, if set.
+	StateFile string
+	// ErrorReportDSN is the DSN of a Sentry compatible error tracker that
+	// panics and backend and watcher errors are reported to, if set.
+	ErrorReportDSN string
+	// TimeSource is the clock that ages are computed against, one of the
+	// TimeSource constants. It defaults to the system clock.
+	TimeSource  string
+	NTPServer   string
+	NTPInterval time.Duration
+	Namespace   string
+	Subsystem   string
+	LogJSON     bool
+	Debug       bool
+
+	// Registerer is where metrics are registered. It defaults to
+	// prometheus.DefaultRegisterer. Exporters embedded in the same process
+	// need a Registerer each, e.g. a prometheus.NewRegistry(). If it is
+	// also a prometheus.Gatherer, NewDefaultServer serves its metrics.
+	Registerer prometheus.Registerer
+	// Sinks are notified of update runs and state changes of all jobs.
+	Sinks []Sink
+	// Now is the exporter's clock. It overrides TimeSource and is meant to
+	// be replaced by tests.
+	Now func() time.Time
+}
+
+// Job configures one monitored process, i.e. a start/end file pair.
+type Job struct {
+	Name              string            `yaml:"name"`
+	StartFile         string            `yaml:"file_start"`
+	EndFile           string            `yaml:"file_end"`
+	StartEvents       Events            `yaml:"file_start_events"`
+	EndEvents         Events            `yaml:"file_end_events"`
+	EndRecursive      bool              `yaml:"file_end_recursive"`
+	Ignore            Patterns          `yaml:"ignore"`
+	TopFiles          int               `yaml:"file_end_top"`
+	EndRequiresStart  bool              `yaml:"file_end_requires_start"`
+	HealthTimeout     time.Duration     `yaml:"health_timeout"`
+	LivenessTimeout   time.Duration     `yaml:"liveness_timeout"`
+	Welpenschutz      time.Duration     `yaml:"health_welpenschutz"`
+	WelpenschutzMode  string            `yaml:"health_welpenschutz_mode"`
+	StrictAnomalies   int               `yaml:"strict_anomalies"`
+	MinDuration       time.Duration     `yaml:"duration_min"`
+	MaxDuration       time.Duration     `yaml:"duration_max"`
+	DurationSource    string            `yaml:"duration_source"`
+	DirectoryRemoved  string            `yaml:"directory_removed"`
+	SyntheticInterval time.Duration     `yaml:"synthetic_interval"`
+	SyntheticDuration time.Duration     `yaml:"synthetic_duration"`
+	CountRowsMaxSize  int64             `yaml:"count_rows_max_size"`
+	RescanInterval    time.Duration     `yaml:"rescan_interval"`
+	RunCheckpoint     time.Duration     `yaml:"run_checkpoint"`
+	Tenant            string            `yaml:"tenant"`
+	Annotations       Annotations       `yaml:"annotations"`
+	Phases            Phases            `yaml:"phases"`
+	Labels            map[string]string `yaml:"labels"`
+}
+
+// jobs returns the jobs to monitor.
+func (c *Config) jobs() []Job {
+	if len(c.Jobs) == 0 {
+		return []Job{c.Job}
+	}
+	return c.Jobs
+}
+
+// LoadJobs reads jobs from a YAML config file of the form
+//
+//	defaults:
+//	  health_timeout: 25h
+//	  labels:
+//	    team: data
+//	jobs:
+//	  - name: nightly-import
+//	    file_start: /data/import/start
+//	    file_end: /data/import/end
+//
+// Settings missing in a job are taken from the defaults section, and those
+// missing there from defaults. Labels and annotations of a job are merged
+// over those of the defaults section.
+func LoadJobs(file string, defaults Job) ([]Job, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Defaults yaml.Node   `yaml:"defaults"`
+		Jobs     []yaml.Node `yaml:"jobs"`
+	}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if len(raw.Jobs) == 0 {
+		return nil, fmt.Errorf("%s: no jobs configured", file)
+	}
+	// Decoding onto a copy of the defaults keeps what is left out.
+	base := defaults
+	base.Name, base.Annotations, base.Labels, base.Phases = "", nil, nil, nil
+	if !raw.Defaults.IsZero() {
+		if err := raw.Defaults.Decode(&base); err != nil {
+			return nil, fmt.Errorf("%s: defaults: %w", file, err)
+		}
+		if base.Name != "" {
+			return nil, fmt.Errorf("%s: defaults: name can't be set", file)
+		}
+	}
+	jobs := make([]Job, len(raw.Jobs))
+	names := make(map[string]bool)
+	for i, node := range raw.Jobs {
+		job := base
+		job.Annotations, job.Labels = nil, nil
+		if err := node.Decode(&job); err != nil {
+			return nil, fmt.Errorf("%s: job %d: %w", file, i+1, err)
+		}
+		job.Labels = mergeMap(base.Labels, job.Labels)
+		job.Annotations = mergeMap(base.Annotations, job.Annotations)
+		if job.Name == "" {
+			return nil, fmt.Errorf("%s: job %d: name must be set", file, i+1)
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("%s: duplicate job name %q", file, job.Name)
+		}
+		names[job.Name] = true
+		for k := range job.Labels {
+			if !validLabelName(k) || reservedLabels[k] {
+				return nil, fmt.Errorf("%s: job %q: invalid label name %q", file, job.Name, k)
+			}
+		}
+		for k := range job.Annotations {
+			// Annotations become labels of update_info next to the
+			// job's labels.
+			if _, ok := job.Labels[k]; !validLabelName(k) || reservedLabels[k] || ok {
+				return nil, fmt.Errorf("%s: job %q: invalid annotation key %q", file, job.Name, k)
+			}
+		}
+		jobs[i] = job
+	}
+	for _, job := range jobs {
+		if overlap := job.overlap(jobs); overlap != "" && job.StrictAnomalies > 0 {
+			return nil, fmt.Errorf("%s: job %q: %s", file, job.Name, overlap)
+		}
+	}
+	return jobs, nil
+}
+
+// ProbeModule is a named set of rules for the probe endpoint, selected by
+// its module parameter like the modules of the blackbox exporter.
+type ProbeModule struct {
+	// Prefixes are the directories the module's targets must be in. If
+	// empty, the stat roots apply.
+	Prefixes []string `yaml:"prefixes"`
+	// Timestamp is TimestampMtime or TimestampCtime.
+	Timestamp string `yaml:"timestamp"`
+	// Glob is GlobNone, GlobNewest or GlobOldest.
+	Glob string `yaml:"glob"`
+	// MaxAge is the age from which the target is stale, unless the probe
+	// gives max_age. Zero only requires the target to exist.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// LoadModules reads the probe modules from the modules section of the YAML
+// file, next to the jobs of LoadJobs:
+//
+//	modules:
+//	  backup:
+//	    prefixes: [/backup]
+//	    glob: oldest
+//	    max_age: 26h
+func LoadModules(file string) (map[string]ProbeModule, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Modules map[string]ProbeModule `yaml:"modules"`
+	}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	for name, m := range raw.Modules {
+		switch m.Timestamp {
+		case "", TimestampMtime, TimestampCtime:
+		default:
+			return nil, fmt.Errorf("%s: module %q: unknown timestamp %q", file, name, m.Timestamp)
+		}
+		switch m.Glob {
+		case "", GlobNone, GlobNewest, GlobOldest:
+		default:
+			return nil, fmt.Errorf("%s: module %q: unknown glob %q", file, name, m.Glob)
+		}
+		if m.MaxAge < 0 {
+			return nil, fmt.Errorf("%s: module %q: max_age must not be negative", file, name)
+		}
+	}
+	return raw.Modules, nil
+}
+
+// Tenant configures an isolated set of metrics. The metrics of jobs with the
+// tenant's name as Job.Tenant are registered with a registry of their own
+// and served at Config.TenantEndpoint only.
+type Tenant struct {
+	// BasicAuthFile protects the metrics of the tenant with the users of
+	// this file, in the format of Config.BasicAuthFile. If empty, they are
+	// served without auth.
+	BasicAuthFile string `yaml:"basic_auth_file"`
+}
+
+// LoadTenants reads the tenants section of the YAML file, e.g.
+//
+//	tenants:
+//	  team-a:
+//	    basic_auth_file: /etc/fileage/team-a.users
+func LoadTenants(file string) (map[string]Tenant, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Tenants map[string]Tenant `yaml:"tenants"`
+	}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	for name := range raw.Tenants {
+		if !validTenantName(name) {
+			return nil, fmt.Errorf("%s: invalid tenant name %q", file, name)
+		}
+	}
+	return raw.Tenants, nil
+}
+
+// mergeMap returns the entries of base overridden by those of m, nil if
+// both are empty.
+func mergeMap[M ~map[string]string](base, m M) M {
+	if len(base) == 0 {
+		return m
+	}
+	merged := make(M, len(base)+len(m))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range m {
+		merged[k] = v
+	}
+	return merged
+}
+
+// jobLabel is the label that tells jobs from a config file apart.
+const jobLabel = "job_name"
+
+// reservedLabels can't be used as job labels as they are already in use by
+// the exporter's metrics.
+var reservedLabels = map[string]bool{
+	jobLabel: true, "kind": true, "check": true, "to": true, "state": true, "quantile": true, "le": true, "role": true, "path": true, "by": true, "reason": true, "phase": true, "rank": true,
+}
+
+// Annotations is freeform metadata about the monitored process, like owner
+// or runbook URL. It implements flag.Value and is set from "key=value".
+type Annotations map[string]string
+
+func (a *Annotations) String() string {
+	if a == nil {
+		return ""
+	}
+	keys := a.keys()
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + (*a)[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// keys returns the annotation keys in sorted order.
+func (a Annotations) keys() []string {
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (a *Annotations) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("annotation %q is not of the form key=value", s)
+	}
+	if !validLabelName(k) {
+		return fmt.Errorf("annotation key %q is not a valid prometheus label name", k)
+	}
+	if reservedLabels[k] {
+		return fmt.Errorf("annotation key %q is reserved", k)
+	}
+	if *a == nil {
+		*a = make(Annotations)
+	}
+	(*a)[k] = v
+	return nil
+}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validLabelName reports whether k may be used as a label name. Names
+// starting with "__" are reserved for Prometheus' internal use.
+func validLabelName(k string) bool {
+	return labelNameRE.MatchString(k) && !strings.HasPrefix(k, "__")
+}
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// validateNames checks that Namespace and Subsystem yield valid metric names,
+// which otherwise would only surface as a panic when registering metrics.
+func (c *Config) validateNames() error {
+	for _, part := range []struct{ name, value string }{
+		{"namespace", c.Namespace},
+		{"subsystem", c.Subsystem},
+	} {
+		if part.value != "" && !metricNameRE.MatchString("_"+part.value) {
+			return fmt.Errorf("invalid prometheus %s %q: only letters, digits, underscores and colons are allowed", part.name, part.value)
+		}
+	}
+	if name := prometheus.BuildFQName(c.Namespace, c.Subsystem, "update_count_total"); !metricNameRE.MatchString(name) {
+		return fmt.Errorf("invalid prometheus namespace %q and subsystem %q: metric name %q must not start with a digit", c.Namespace, c.Subsystem, name)
+	}
+	return nil
 }
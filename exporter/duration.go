@@ -0,0 +1,158 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Buckets are the upper bounds of histogram buckets. It implements
+// flag.Value and is set from a comma separated list like "1m,10m,1h".
+type Buckets []time.Duration
+
+func (b *Buckets) String() string {
+	if b == nil {
+		return ""
+	}
+	s := make([]string, len(*b))
+	for i, d := range *b {
+		s[i] = d.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (b *Buckets) Set(s string) error {
+	var bs Buckets
+	for _, f := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(f))
+		if err != nil {
+			return fmt.Errorf("invalid bucket: %w", err)
+		}
+		bs = append(bs, d)
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i] < bs[j] })
+	for i := 1; i < len(bs); i++ {
+		if bs[i] == bs[i-1] {
+			return fmt.Errorf("duplicate bucket %s", bs[i])
+		}
+	}
+	*b = bs
+	return nil
+}
+
+// seconds returns the bucket bounds in seconds.
+func (b Buckets) seconds() []float64 {
+	s := make([]float64, len(b))
+	for i, d := range b {
+		s[i] = d.Seconds()
+	}
+	return s
+}
+
+// Objectives are the quantiles of a summary mapped to their allowed absolute
+// error. It implements flag.Value and is set from a comma separated list of
+// quantile:error pairs like "0.5:0.05,0.99:0.001".
+type Objectives map[float64]float64
+
+func (o *Objectives) String() string {
+	if o == nil {
+		return ""
+	}
+	qs := make([]float64, 0, len(*o))
+	for q := range *o {
+		qs = append(qs, q)
+	}
+	sort.Float64s(qs)
+	s := make([]string, len(qs))
+	for i, q := range qs {
+		s[i] = strconv.FormatFloat(q, 'g', -1, 64) + ":" + strconv.FormatFloat((*o)[q], 'g', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+func (o *Objectives) Set(s string) error {
+	obj := make(Objectives)
+	for _, f := range strings.Split(s, ",") {
+		qs, es, ok := strings.Cut(strings.TrimSpace(f), ":")
+		if !ok {
+			return fmt.Errorf("objective %q is not of the form quantile:error", f)
+		}
+		q, err := strconv.ParseFloat(qs, 64)
+		if err != nil || q <= 0 || q >= 1 {
+			return fmt.Errorf("invalid quantile %q", qs)
+		}
+		e, err := strconv.ParseFloat(es, 64)
+		if err != nil || e < 0 || e >= 1 {
+			return fmt.Errorf("invalid error %q of quantile %s", es, qs)
+		}
+		obj[q] = e
+	}
+	*o = obj
+	return nil
+}
+
+// defaultDurationBuckets span update runs from a second to about 36 hours.
+var defaultDurationBuckets = prometheus.ExponentialBuckets(1, 2, 18)
+
+// The summary of Config.LowResource keeps two age buckets of 64 samples,
+// where prometheus defaults to five of 500.
+const (
+	lowResourceAgeBuckets = 2
+	lowResourceBufCap     = 64
+)
+
+// durationObserver is the Summary or Histogram of update_duration_seconds.
+type durationObserver interface {
+	prometheus.Collector
+	prometheus.Observer
+}
+
+// newDurationObserver returns update_duration_seconds as configured by c.
+// All jobs share the type, as metrics of the same name must agree on it.
+func newDurationObserver(c *Config, ns, sub string) durationObserver {
+	const name, help = "update_duration_seconds", "Duration of update runs in seconds."
+	if !c.DurationHistogram {
+		opts := prometheus.SummaryOpts{
+			Namespace:  ns,
+			Subsystem:  sub,
+			Name:       name,
+			Help:       help,
+			Objectives: c.DurationObjectives,
+			MaxAge:     c.DurationMaxAge,
+		}
+		if c.LowResource {
+			opts.AgeBuckets, opts.BufCap = lowResourceAgeBuckets, lowResourceBufCap
+		}
+		return prometheus.NewSummary(opts)
+	}
+	buckets := defaultDurationBuckets
+	if len(c.DurationBuckets) > 0 {
+		buckets = c.DurationBuckets.seconds()
+	}
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:                   ns,
+		Subsystem:                   sub,
+		Name:                        name,
+		Help:                        help,
+		Buckets:                     buckets,
+		NativeHistogramBucketFactor: c.DurationNativeFactor,
+	})
+}
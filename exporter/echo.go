@@ -0,0 +1,94 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// echoParams parses the comma separated query parameters of
+// Config.EchoParams, which are echoed as labels on scrapes.
+func echoParams(s string) ([]string, error) {
+	var params []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !validLabelName(p) || reservedLabels[p] {
+			return nil, fmt.Errorf("invalid label name %q", p)
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+// echoHandler serves the metrics of g, labeled with the echoed query
+// parameters of each scrape, e.g. module=sftp for /metrics?module=sftp.
+func (x *Exporter) echoHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var pairs []*dto.LabelPair
+		for _, name := range x.echoParams {
+			if v := q.Get(name); v != "" {
+				name := name
+				pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &v})
+			}
+		}
+		promhttp.HandlerFor(echoGatherer{g, pairs}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// echoGatherer adds labels to all series gathered from a Gatherer. Series
+// that already have a label of the same name keep theirs.
+type echoGatherer struct {
+	prometheus.Gatherer
+	pairs []*dto.LabelPair
+}
+
+func (e echoGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := e.Gatherer.Gather()
+	if len(e.pairs) == 0 {
+		return mfs, err
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			m.Label = addLabels(m.Label, e.pairs)
+		}
+	}
+	return mfs, err
+}
+
+// addLabels adds the pairs missing in labels, keeping them sorted by name.
+func addLabels(labels, pairs []*dto.LabelPair) []*dto.LabelPair {
+	have := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		have[l.GetName()] = true
+	}
+	for _, p := range pairs {
+		if !have[p.GetName()] {
+			labels = append(labels, p)
+		}
+	}
+	sort.Slice(labels, func(i, k int) bool { return labels[i].GetName() < labels[k].GetName() })
+	return labels
+}
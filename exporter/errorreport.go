@@ -0,0 +1,197 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportInterval is how often the same error of a job is reported at most,
+// so that a watcher failing in a loop doesn't flood the error tracker.
+const reportInterval = 10 * time.Minute
+
+// errorReporter sends errors and panics to a Sentry compatible error
+// tracker, see Config.ErrorReportDSN.
+type errorReporter struct {
+	url      string
+	auth     string
+	hostname string
+	release  string
+	client   *http.Client
+	log      Logger
+
+	events chan errorEvent
+	done   chan struct{}
+
+	mu   sync.Mutex
+	last map[string]time.Time // by job and message
+}
+
+// errorEvent is an event of the Sentry store API.
+type errorEvent struct {
+	EventID    string            `json:"event_id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Level      string            `json:"level"`
+	Logger     string            `json:"logger"`
+	Platform   string            `json:"platform"`
+	ServerName string            `json:"server_name"`
+	Release    string            `json:"release,omitempty"`
+	Message    string            `json:"message"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// newErrorReporter returns a reporter for dsn, which has the form
+// https://public_key@host/project_id.
+func newErrorReporter(dsn string, logger Logger) (*errorReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	key := u.User.Username()
+	i := strings.LastIndex(u.Path, "/")
+	if u.Host == "" || key == "" || i < 0 || u.Path[i+1:] == "" {
+		return nil, fmt.Errorf("%q is not of the form https://public_key@host/project_id", dsn)
+	}
+	hostname, _ := os.Hostname()
+	version, _, _ := BuildInfo()
+	r := &errorReporter{
+		url:      fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, u.Path[:i], u.Path[i+1:]),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=prometheus_fileage_exporter/%s, sentry_key=%s", version, key),
+		hostname: hostname,
+		release:  version,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		log:      logger,
+		events:   make(chan errorEvent, 16),
+		done:     make(chan struct{}),
+		last:     make(map[string]time.Time),
+	}
+	go r.send()
+	return r, nil
+}
+
+// report sends msg about job j in the background, unless the same message
+// has been reported for j within reportInterval. It never blocks; events
+// are dropped if the error tracker can't keep up.
+func (r *errorReporter) report(j *job, msg string) {
+	if r == nil {
+		return
+	}
+	key := j.c.Name + "\x00" + msg
+	r.mu.Lock()
+	if time.Since(r.last[key]) < reportInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.last[key] = time.Now()
+	r.mu.Unlock()
+	select {
+	case r.events <- r.event("error", j, msg):
+	default:
+	}
+}
+
+// reportPanic reports a panic of a goroutine of job j and panics on. It must
+// be deferred.
+func (r *errorReporter) reportPanic(j *job) {
+	if r == nil {
+		return
+	}
+	if p := recover(); p != nil {
+		if err := r.post(r.event("fatal", j, fmt.Sprintf("panic: %v", p))); err != nil {
+			r.log.Printf("Error reporting panic: %v", err)
+		}
+		panic(p)
+	}
+}
+
+// event returns an event with the context of job j, which may be nil.
+func (r *errorReporter) event(level string, j *job, msg string) errorEvent {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	e := errorEvent{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  time.Now().UTC(),
+		Level:      level,
+		Logger:     "fileage_exporter",
+		Platform:   "go",
+		ServerName: r.hostname,
+		Release:    r.release,
+		Message:    msg,
+	}
+	if j != nil {
+		e.Tags = map[string]string{"file_end": j.endFile}
+		if j.startFile != "" {
+			e.Tags["file_start"] = j.startFile
+		}
+		if j.c.Name != "" {
+			e.Tags[jobLabel] = j.c.Name
+		}
+	}
+	return e
+}
+
+// send posts queued events until close.
+func (r *errorReporter) send() {
+	for {
+		select {
+		case e := <-r.events:
+			if err := r.post(e); err != nil {
+				r.log.Printf("Error reporting error: %v", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// post sends e to the error tracker.
+func (r *errorReporter) post(e errorEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error tracker responded %s", resp.Status)
+	}
+	return nil
+}
+
+// close stops sending events. Queued events are dropped.
+func (r *errorReporter) close() {
+	if r != nil {
+		close(r.done)
+	}
+}
@@ -0,0 +1,60 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDirectoryTimeout is wrapped by a WatchError when a directory didn't
+// become watchable within Config.DirectoryTimeout.
+var ErrDirectoryTimeout = errors.New("directory timeout")
+
+// ErrRetriesExhausted is wrapped by a WatchError when a directory didn't
+// become watchable within RetryPolicy.MaxAttempts retries.
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+// ConfigError is returned by New for an invalid configuration. Job is the
+// name of the offending job from the config file, if any.
+type ConfigError struct {
+	Job string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Job != "" {
+		return fmt.Sprintf("job %q: %v", e.Job, e.Err)
+	}
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// WatchError is returned by New when a directory can't be watched.
+type WatchError struct {
+	Job  string
+	Path string
+	Err  error
+}
+
+func (e *WatchError) Error() string {
+	if e.Job != "" {
+		return fmt.Sprintf("job %q: watching %q: %v", e.Job, e.Path, e.Err)
+	}
+	return fmt.Sprintf("watching %q: %v", e.Path, e.Err)
+}
+
+func (e *WatchError) Unwrap() error { return e.Err }
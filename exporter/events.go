@@ -0,0 +1,85 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Events is a set of fs event kinds that trigger an update for a watched
+// file. It only filters events; the update still derives the state from the
+// mtimes. The zero value matches every event kind. It implements flag.Value
+// and is set from a comma separated list like "create,write".
+type Events fsnotify.Op
+
+var eventNames = []struct {
+	name string
+	op   fsnotify.Op
+}{
+	{"create", fsnotify.Create},
+	{"write", fsnotify.Write},
+	{"remove", fsnotify.Remove},
+	{"rename", fsnotify.Rename},
+	{"chmod", fsnotify.Chmod},
+}
+
+func (ev *Events) String() string {
+	if ev == nil || *ev == 0 {
+		return "all"
+	}
+	var names []string
+	for _, n := range eventNames {
+		if fsnotify.Op(*ev).Has(n.op) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (ev *Events) Set(s string) error {
+	var mask fsnotify.Op
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "all" {
+			*ev = 0
+			return nil
+		}
+		found := false
+		for _, n := range eventNames {
+			if n.name == name {
+				mask |= n.op
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown event kind %q", name)
+		}
+	}
+	*ev = Events(mask)
+	return nil
+}
+
+// UnmarshalText allows Events to be read from config files.
+func (ev *Events) UnmarshalText(text []byte) error {
+	return ev.Set(string(text))
+}
+
+// match reports whether op is one of the configured event kinds.
+func (ev Events) match(op fsnotify.Op) bool {
+	return ev == 0 || op&fsnotify.Op(ev) != 0
+}
@@ -15,245 +15,449 @@
 package exporter
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"reflect"
 	"sync"
+	"text/template"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Exporter struct {
-	c                          *Config
-	promUpdateCount            prometheus.Counter
-	promUpdateAge              prometheus.Gauge
-	promUpdateRunning          prometheus.Gauge
-	promUpdateDuration         prometheus.Summary
-	onceRegisterUpdateRunning  sync.Once
-	onceRegisterUpdateDuration sync.Once
-	onceRegisterUpdateAge      sync.Once
-	startup                    time.Time
-	promHandler                http.Handler
-	log                        Logger
-
-	mu     sync.RWMutex
-	start  time.Time
-	end    time.Time
-	oldEnd time.Time
+	c   *Config
+	log Logger
+
+	// mu guards jobs, modules and tenants, which are replaced by Reload.
+	mu       sync.RWMutex
+	jobs     []*job
+	modules  map[string]probeModule
+	tenants  map[string]*tenant
+	reloadMu sync.Mutex
+
+	healthTemplate *template.Template
+	selftest       *selftest
+	auth           *basicAuth
+	statRoots      []string
+	echoParams     []string
+	collectors     []prometheus.Collector
+	registerErr    error            // first failed registration
+	failedJobs     []func()         // see failedJob
+	clock          func() time.Time // of Config.TimeSource
+	stopClock      func()
+	reporter       *errorReporter // nil unless Config.ErrorReportDSN is set
+	poller         *poller        // nil unless Config.PollInterval is set
+	done           chan struct{}  // closed by Close to stop background loops
+
+	stateMu    sync.Mutex
+	state      map[string]jobState // by job name, see Config.StateFile
+	stateDirty bool                // a job changed since the state was saved
+	stateLoop  chan struct{}       // closed once saveStateLoop returned
 }
 
+// NewExporter is like New, but terminates the process on error.
 func NewExporter(c *Config) *Exporter {
 	logger := log.New(os.Stderr, "", log.LstdFlags)
 	return NewExporterWithLogger(c, logger)
 }
 
+// NewExporterWithLogger is like NewWithLogger, but terminates the process on
+// error.
 func NewExporterWithLogger(c *Config, logger Logger) *Exporter {
+	x, err := NewWithLogger(c, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return x
+}
+
+// New creates an exporter and starts watching the files of its jobs. Errors
+// are of type *ConfigError or *WatchError; on error nothing is left
+// registered or watched.
+func New(c *Config) (*Exporter, error) {
+	return NewWithLogger(c, log.New(os.Stderr, "", log.LstdFlags))
+}
+
+// NewWithLogger is like New, logging to logger. The exporter never calls the
+// Fatal methods of logger.
+func NewWithLogger(c *Config, logger Logger) (*Exporter, error) {
+	if err := c.validateNames(); err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+	switch c.LivenessMode {
+	case "", LivenessStaleness, LivenessInternal:
+	default:
+		return nil, &ConfigError{Err: fmt.Errorf("unknown liveness mode %q", c.LivenessMode)}
+	}
+	switch c.HealthAggregate {
+	case "", HealthAggregateAny, HealthAggregateAll:
+	default:
+		return nil, &ConfigError{Err: fmt.Errorf("unknown health aggregate %q", c.HealthAggregate)}
+	}
+	if c.HealthFailureStatus != 0 && (c.HealthFailureStatus < 400 || c.HealthFailureStatus > 599) {
+		return nil, &ConfigError{Err: fmt.Errorf("health failure status %d is not an error status", c.HealthFailureStatus)}
+	}
+	if err := c.validateTimeSource(); err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+	if c.DurationNativeFactor != 0 && (!c.DurationHistogram || c.DurationNativeFactor <= 1) {
+		return nil, &ConfigError{Err: errors.New("a native histogram factor needs a duration histogram and must be greater than 1")}
+	}
 	x := &Exporter{
-		c:       c,
-		startup: time.Now(),
-		log:     logger,
-		promUpdateCount: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: c.Namespace,
-			Subsystem: c.Subsystem,
-			Name:      "update_count_total",
-			Help:      "Counter of update runs.",
-		}),
-		promUpdateAge: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: c.Namespace,
-			Subsystem: c.Subsystem,
-			Name:      "update_age_seconds",
-			Help:      "Time since last time an update finished.",
-		}),
-		promUpdateRunning: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: c.Namespace,
-			Subsystem: c.Subsystem,
-			Name:      "update_running",
-			Help:      "If the monitored process seems to run: 0 no; 1 yes.",
-		}),
-		promUpdateDuration: prometheus.NewSummary(prometheus.SummaryOpts{
-			Namespace: c.Namespace,
-			Subsystem: c.Subsystem,
-			Name:      "update_duration_seconds",
-			Help:      "Duration of update runs in seconds.",
-		}),
-	}
-	prometheus.MustRegister(x.promUpdateCount)
-
-	var (
-		startFile, endFile string
-		err                error
-	)
-	if x.c.StartFile != "" {
-		startFile, err = filepath.Abs(x.c.StartFile)
+		c:    c,
+		log:  logger,
+		done: make(chan struct{}),
+	}
+
+	var err error
+	if x.c.HealthTemplate != "" {
+		x.healthTemplate, err = parseHealthTemplate(x.c.HealthTemplate)
 		if err != nil {
-			logger.Fatal(err)
+			return nil, &ConfigError{Err: fmt.Errorf("reading health template: %w", err)}
 		}
 	}
-	if x.c.EndFile == "" {
-		logger.Fatalln("--end-file must be set!")
+
+	if c.BasicAuthFile != "" {
+		x.auth, err = newBasicAuth(c.BasicAuthFile, c.BasicAuthEndpoints)
+		if err != nil {
+			return nil, &ConfigError{Err: fmt.Errorf("configuring basic auth: %w", err)}
+		}
 	}
-	endFile, err = filepath.Abs(x.c.EndFile)
+
+	x.statRoots, err = statRoots(c.StatRoots)
 	if err != nil {
-		logger.Fatal(err)
+		return nil, &ConfigError{Err: fmt.Errorf("resolving stat API roots: %w", err)}
 	}
 
-	startWatcher, endWatcher := x.createWatcher(startFile), x.createWatcher(endFile)
-	x.watch(startWatcher, endWatcher)
+	x.echoParams, err = echoParams(c.EchoParams)
+	if err != nil {
+		return nil, &ConfigError{Err: fmt.Errorf("echoed query parameters: %w", err)}
+	}
 
-	return x
-}
+	if c.ConfigFile != "" {
+		c.Jobs, err = LoadJobs(c.ConfigFile, c.Job)
+		if err != nil {
+			return nil, &ConfigError{Err: err}
+		}
+		x.modules, err = x.loadModules(c.ConfigFile)
+		if err != nil {
+			return nil, &ConfigError{Err: err}
+		}
+		auths, err := x.loadTenants(c.ConfigFile)
+		if err != nil {
+			return nil, &ConfigError{Err: err}
+		}
+		x.setTenantAuth(auths)
+	}
+	jobs := c.jobs()
+	for _, jc := range jobs {
+		if _, _, err := jc.resolve(); err != nil {
+			return nil, &ConfigError{Job: jc.Name, Err: err}
+		}
+	}
 
-func (x *Exporter) WrapPromHandler(handler http.Handler) {
-	x.promHandler = handler
-}
+	if c.StateFile != "" {
+		if err := x.loadState(); err != nil {
+			// Better to start over than not to start.
+			logger.Printf("Error reading state file, starting without: %v", err)
+		}
+	}
 
-func (x *Exporter) createWatcher(filename string) *fsnotify.Watcher {
-	if filename == "" {
-		// return a watcher that will block forever
-		return &fsnotify.Watcher{}
+	if c.ErrorReportDSN != "" {
+		x.reporter, err = newErrorReporter(c.ErrorReportDSN, logger)
+		if err != nil {
+			return nil, &ConfigError{Err: fmt.Errorf("error report DSN: %w", err)}
+		}
 	}
 
-	w, err := fsnotify.NewWatcher()
-	if err != nil {
-		x.log.Fatalf("Error creating fs notifier: %v", err)
-	}
-	dir := filepath.Dir(filename)
-	deadline := time.NewTimer(time.Until(x.startup.Add(x.c.DirectoryTimeout)))
-retry:
-	for backoff := time.Second; ; backoff *= 2 {
-		addErr := w.Add(dir)
-		if addErr == nil {
-			break retry
+	x.register(newInstanceInfo(), newBuildInfo())
+	x.clock, x.stopClock = x.referenceClock()
+	if c.TimeSource != "" && c.TimeSource != TimeSourceSystem {
+		x.register(x.newClockOffset())
+	}
+	if c.SelftestDir != "" {
+		x.selftest, err = x.newSelftest(c.SelftestDir)
+		if err != nil {
+			x.Close()
+			return nil, err
 		}
-		select {
-		case <-time.After(backoff):
-			x.log.Printf("Retrying to add directory \"%s\" in %s after error: %v", dir, backoff, addErr)
-			continue retry
-		case <-deadline.C:
-			x.log.Fatalf("Giving up adding directory \"%s\": %v", dir, addErr)
+	}
+	if x.registerErr != nil {
+		x.Close()
+		return nil, &ConfigError{Err: fmt.Errorf("registering metrics: %w", x.registerErr)}
+	}
+	if c.PollInterval > 0 {
+		x.poller = newPoller(c.PollInterval, x.done)
+	}
+	for _, jc := range jobs {
+		j, err := newJob(x, jc, jobs)
+		if err != nil {
+			x.Close()
+			return nil, err
 		}
+		// The watch loops of the jobs read x.jobs already.
+		x.mu.Lock()
+		x.jobs = append(x.jobs, j)
+		x.mu.Unlock()
+	}
+	if c.StateFile != "" {
+		x.stateLoop = make(chan struct{})
+		go x.saveStateLoop()
 	}
-	return w
+
+	return x, nil
 }
 
-func (x *Exporter) watch(startWatcher, endWatcher *fsnotify.Watcher) {
-	go func() {
-		bs := filepath.Base(x.c.StartFile)
-		be := filepath.Base(x.c.EndFile)
-
-		x.update()
-		for {
-			select {
-			case e := <-startWatcher.Events:
-				if filepath.Base(e.Name) == bs {
-					x.update()
-				}
-			case e := <-endWatcher.Events:
-				if filepath.Base(e.Name) == be {
-					x.update()
-				}
-			case err := <-startWatcher.Errors:
-				x.log.Printf("Error waiting for fs event on start file: %v", err)
-			case err := <-endWatcher.Errors:
-				x.log.Printf("Error waiting for fs event on end file: %v", err)
-			}
+// register registers metrics of the exporter itself, remembering them for
+// Close. After the first failure it registers nothing more and keeps the
+// error in registerErr.
+func (x *Exporter) register(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if x.registerErr != nil {
+			return
 		}
-	}()
+		if err := x.registerer().Register(c); err != nil {
+			x.registerErr = err
+			return
+		}
+		x.collectors = append(x.collectors, c)
+	}
 }
 
-// in case of error returns zero time.Time
-func measure(filename string) (mtime time.Time) {
-	if filename == "" {
-		return
+// registerer returns where metrics are registered.
+func (x *Exporter) registerer() prometheus.Registerer {
+	if x.c.Registerer != nil {
+		return x.c.Registerer
 	}
-	stat, err := os.Stat(filename)
-	if err != nil {
-		return
+	return prometheus.DefaultRegisterer
+}
+
+// now returns the current time of the exporter's clock.
+func (x *Exporter) now() time.Time {
+	if x.c.Now != nil {
+		return x.c.Now()
 	}
-	return stat.ModTime()
+	return x.clock()
 }
 
-func (x *Exporter) update() {
-	start, end := measure(x.c.StartFile), measure(x.c.EndFile)
+// since returns the time elapsed since t by the exporter's clock.
+func (x *Exporter) since(t time.Time) time.Duration {
+	return x.now().Sub(t)
+}
 
-	x.mu.Lock()
-	defer x.mu.Unlock()
+// currentJobs returns the jobs being monitored.
+func (x *Exporter) currentJobs() []*job {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.jobs
+}
 
-	x.start, x.end = start, end
+// Reload re-reads the config file and replaces the monitored jobs. Jobs
+// whose configuration did not change keep running along with their metrics.
+// If the new configuration is invalid, the old one is kept and an error is
+// returned. Jobs whose directories can't be watched are left out and retried
+// by the next reload; their errors are returned.
+func (x *Exporter) Reload() error {
+	if x.c.ConfigFile == "" {
+		return errors.New("no config file to reload")
+	}
+	x.reloadMu.Lock()
+	defer x.reloadMu.Unlock()
 
-	if !start.IsZero() {
-		x.onceRegisterUpdateRunning.Do(func() { prometheus.MustRegister(x.promUpdateRunning) })
-		if end.IsZero() || start.After(end) {
-			if x.c.Debug {
-				x.log.Printf("An update run started.")
-			}
-			x.promUpdateRunning.Set(1)
-		} else {
-			x.promUpdateRunning.Set(0)
+	jobs, err := LoadJobs(x.c.ConfigFile, x.c.Job)
+	if err != nil {
+		x.markReloadFailed(true)
+		return err
+	}
+	for _, jc := range jobs {
+		if _, _, err := jc.resolve(); err != nil {
+			x.markReloadFailed(true)
+			return &ConfigError{Job: jc.Name, Err: err}
 		}
 	}
+	modules, err := x.loadModules(x.c.ConfigFile)
+	if err != nil {
+		x.markReloadFailed(true)
+		return &ConfigError{Err: err}
+	}
+	auths, err := x.loadTenants(x.c.ConfigFile)
+	if err != nil {
+		x.markReloadFailed(true)
+		return &ConfigError{Err: err}
+	}
+	// Before any job registers with a new tenant, so its metrics are never
+	// served without the auth configured for it.
+	x.mu.Lock()
+	x.setTenantAuth(auths)
+	x.mu.Unlock()
 
-	if !end.IsZero() && end != x.oldEnd {
-		x.oldEnd = end
-		if start.After(end) || x.startup.After(end) {
-			return
+	old := make(map[string]*job)
+	// Jobs must agree on label names, so if these change every job has to
+	// register its metrics anew.
+	if sameLabelNames(x.c.Jobs, jobs) {
+		for _, j := range x.currentJobs() {
+			old[j.c.Name] = j
 		}
-		if x.c.Debug {
-			x.log.Printf("An update run ended.")
+	}
+	kept := make(map[*job]bool)
+	for _, jc := range jobs {
+		if j, ok := old[jc.Name]; ok && reflect.DeepEqual(j.c, jc) && j.sameFiles(jc) {
+			kept[j] = true
+		}
+	}
+	for _, j := range x.currentJobs() {
+		if !kept[j] {
+			j.close()
+			// Its replacement continues from here.
+			x.keepState(j)
 		}
-		x.promUpdateCount.Inc()
-		if !start.IsZero() {
-			x.onceRegisterUpdateDuration.Do(func() { prometheus.MustRegister(x.promUpdateDuration) })
-			x.promUpdateDuration.Observe(end.Sub(start).Seconds())
+	}
+	x.dropFailedJobs()
+	next := make([]*job, 0, len(jobs))
+	var errs []error
+	for _, jc := range jobs {
+		if j, ok := old[jc.Name]; ok && kept[j] {
+			next = append(next, j)
+			continue
+		}
+		j, err := newJob(x, jc, jobs)
+		if err != nil {
+			// The replaced jobs are gone already, so carry on with the
+			// others. The failed job is retried by the next reload, and
+			// until then it is visible by its config error.
+			errs = append(errs, err)
+			x.failedJobs = append(x.failedJobs, x.failedJob(jc, jobs))
+			continue
 		}
+		next = append(next, j)
 	}
+
+	x.mu.Lock()
+	x.jobs = next
+	x.c.Jobs = jobs
+	x.modules = modules
+	x.mu.Unlock()
+	// Removed jobs are dropped from the state file.
+	x.stateChanged()
+	x.markReloadFailed(false)
+	x.log.Printf("Reloaded %s: %d jobs, %d unchanged", x.c.ConfigFile, len(next), len(kept))
+	return errors.Join(errs...)
 }
 
-// PromHandler updates update_age just before handling scrape
-func (x *Exporter) PromHandler(w http.ResponseWriter, r *http.Request) {
-	x.mu.RLock()
-	myEnd := x.end
-	x.mu.RUnlock()
+// Run blocks until ctx is done and then closes the exporter. The exporter
+// watches from New on; Run merely ties its lifetime to ctx.
+func (x *Exporter) Run(ctx context.Context) error {
+	<-ctx.Done()
+	x.Close()
+	return nil
+}
 
-	if !myEnd.IsZero() {
-		x.onceRegisterUpdateAge.Do(func() { prometheus.MustRegister(x.promUpdateAge) })
-		x.promUpdateAge.Set(time.Since(myEnd).Seconds())
+// markReloadFailed sets or clears the reload_failed config error of the
+// current jobs, which keep running with their previous configuration.
+func (x *Exporter) markReloadFailed(failed bool) {
+	for _, j := range x.currentJobs() {
+		j.setConfigError(configErrorReload, failed)
 	}
-	x.promHandler.ServeHTTP(w, r)
 }
 
-func (x *Exporter) healthHandler(w http.ResponseWriter, r *http.Request) {
-	x.writeStatusResponse(w, x.c.HealthTimeout, x.c.Welpenschutz)
+// failedJob registers config_error_info{reason="reload_failed"} for job c,
+// which the reload could not create, and returns a func that unregisters it.
+func (x *Exporter) failedJob(c Job, all []Job) func() {
+	reg := jobRegisterer(x.tenantRegisterer(c.Tenant), c, all)
+	g := newConfigErrorVec(x.c.Namespace, x.c.Subsystem)
+	g.WithLabelValues(configErrorReload).Set(1)
+	if err := reg.Register(g); err != nil {
+		x.log.Printf("Error registering config error of job %q: %v", c.Name, err)
+		return func() {}
+	}
+	return func() { reg.Unregister(g) }
 }
 
-func (x *Exporter) livenessHandler(w http.ResponseWriter, r *http.Request) {
-	x.writeStatusResponse(w, x.c.LivenessTimeout, 0)
+// dropFailedJobs unregisters the placeholders of failedJob. Must be called
+// with x.reloadMu held.
+func (x *Exporter) dropFailedJobs() {
+	for _, drop := range x.failedJobs {
+		drop()
+	}
+	x.failedJobs = nil
 }
 
-func (x *Exporter) writeStatusResponse(w http.ResponseWriter, timeout, welpenschutz time.Duration) {
-	x.mu.RLock()
-	myEnd := x.end
-	x.mu.RUnlock()
-
-	updateAge := time.Since(myEnd)
-	good := updateAge < timeout
-	if welpenschutz > 0 && time.Since(x.startup) < welpenschutz {
-		good = true
-	}
-
-	const body = "last_update: %s\r\n" +
-		"# time %s means never.\r\n" +
-		"# alive/healthy: %t\r\n"
-	endF := myEnd.Format(time.RFC3339Nano)
-	if good {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		_, _ = fmt.Fprintf(w, body, endF, time.Time{}, good)
-	} else {
-		http.Error(w, fmt.Sprintf(body, endF, time.Time{}, good), http.StatusServiceUnavailable)
+// Close stops watching the files of all jobs, releases the fs notifiers and
+// unregisters all metrics. It returns once the watch loops have finished.
+func (x *Exporter) Close() {
+	x.reloadMu.Lock()
+	defer x.reloadMu.Unlock()
+	select {
+	case <-x.done:
+	default:
+		close(x.done)
+	}
+	// The watch loops take x.mu, so close the jobs without holding it.
+	x.mu.Lock()
+	jobs := x.jobs
+	x.jobs = nil
+	x.mu.Unlock()
+	for _, j := range jobs {
+		j.close()
+	}
+	// Unless New failed, which must not drop the state of the jobs it
+	// didn't get to.
+	if x.stateLoop != nil {
+		<-x.stateLoop
+		x.saveState(jobs)
+	}
+	if x.poller != nil {
+		<-x.poller.loop
+	}
+	if x.selftest != nil {
+		x.selftest.close()
+	}
+	if x.stopClock != nil {
+		x.stopClock()
+		x.stopClock = nil
+	}
+	x.dropFailedJobs()
+	x.reporter.close()
+	x.reporter = nil
+	for _, c := range x.collectors {
+		x.registerer().Unregister(c)
+	}
+	x.collectors = nil
+}
+
+// sameLabelNames reports whether a and b use the same job label and
+// annotation keys.
+func sameLabelNames(a, b []Job) bool {
+	keys := func(jobs []Job) map[string]bool {
+		m := make(map[string]bool)
+		for _, j := range jobs {
+			for k := range j.Labels {
+				m["label:"+k] = true
+			}
+			for k := range j.Annotations {
+				m["annotation:"+k] = true
+			}
+		}
+		return m
+	}
+	return reflect.DeepEqual(keys(a), keys(b))
+}
+
+func (x *Exporter) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := x.Reload(); err != nil {
+		x.log.Printf("Error reloading config: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
 }
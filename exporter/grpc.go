@@ -0,0 +1,84 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// gRPC health service names. The empty service name reports the same as the
+// health endpoint, as is the convention of grpc.health.v1.
+const (
+	grpcHealthService   = ""
+	grpcLivenessService = "liveness"
+)
+
+// grpcHealthHandler wraps next so that gRPC requests on the same listener are
+// answered by a grpc.health.v1.Health server. Plaintext HTTP/2 (h2c) is
+// supported as that's what gRPC health probes use without TLS.
+func (x *Exporter) grpcHealthHandler(next http.Handler) http.Handler {
+	hs := health.NewServer()
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, hs)
+	// health.NewServer reports SERVING until told otherwise.
+	x.setGRPCHealth(hs)
+	go x.updateGRPCHealth(hs)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			gs.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+// updateGRPCHealth periodically re-evaluates health and liveness, because
+// both change with time passing and not only with fs events. The health
+// server only notifies watchers on actual changes. It returns once the
+// exporter is closed.
+func (x *Exporter) updateGRPCHealth(hs *health.Server) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			x.setGRPCHealth(hs)
+		case <-x.done:
+			return
+		}
+	}
+}
+
+// setGRPCHealth sets the serving status of the gRPC health services.
+func (x *Exporter) setGRPCHealth(hs *health.Server) {
+	servingStatus := func(sts []status) healthpb.HealthCheckResponse_ServingStatus {
+		if x.good(sts) {
+			return healthpb.HealthCheckResponse_SERVING
+		}
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	hs.SetServingStatus(grpcHealthService, servingStatus(x.healthStatus()))
+	hs.SetServingStatus(grpcLivenessService, servingStatus(x.livenessStatus()))
+}
@@ -0,0 +1,657 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// status is the result of a health or liveness evaluation of a job.
+type status struct {
+	job          *job
+	check        string
+	state        string
+	end          time.Time
+	acked        time.Time
+	timeout      time.Duration
+	good         bool
+	welpenschutz bool
+	// remaining is the remaining welpenschutz, see welpenschutzRemaining.
+	remaining    time.Duration
+	anomalies    int
+	degraded     bool
+	lastDuration time.Duration
+	// vanished is set while a watched directory is missing.
+	vanished bool
+	// internal is set if good reflects the exporter's own liveness rather
+	// than the age of the end file.
+	internal bool
+	// snoozed is the end of an active snooze of the health check, which
+	// passes it regardless of the others.
+	snoozed time.Time
+}
+
+// parseHealthTemplate reads a text/template for health and liveness
+// response bodies from file.
+func parseHealthTemplate(file string) (*template.Template, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("health").Parse(string(b))
+}
+
+// healthTemplateData is passed to the health response template.
+type healthTemplateData struct {
+	Job          string // empty if configured by flags
+	Check        string // "health" or "liveness"
+	State        string
+	File         string // the end file
+	LastUpdate   time.Time
+	Age          time.Duration
+	Threshold    time.Duration
+	Healthy      bool
+	Welpenschutz bool
+	// WelpenschutzRemaining is 0 unless the welpenschutz ends after a
+	// duration.
+	WelpenschutzRemaining time.Duration
+	Degraded              bool
+	Anomalies             int
+	LastDuration          time.Duration
+	Hostname              string
+	Annotations           map[string]string
+	// SnoozedUntil is zero unless the job is snoozed.
+	SnoozedUntil time.Time
+}
+
+func (x *Exporter) healthHandler(w http.ResponseWriter, r *http.Request) {
+	x.writeStatusResponse(w, r, x.healthStatus())
+}
+
+// jobHealthHandler serves the health of the single job named by the path
+// below the health endpoint, e.g. /healthz/nightly-import.
+func (x *Exporter) jobHealthHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, jobHealthPrefix(x.c.HealthEndpoint))
+	for _, j := range x.currentJobs() {
+		if j.c.Name == name {
+			x.writeStatusResponse(w, r, []status{j.healthStatus()})
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("unknown job %q", name), http.StatusNotFound)
+}
+
+// jobHealthPrefix returns the path below which the health of single jobs is
+// served.
+func jobHealthPrefix(endpoint string) string {
+	return strings.TrimSuffix(endpoint, "/") + "/"
+}
+
+func (x *Exporter) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	x.writeStatusResponse(w, r, x.livenessStatus())
+}
+
+// readinessHandler reports ready once the directories of all jobs are
+// watched and their files have been measured, regardless of their age.
+func (x *Exporter) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	ready := true
+	for _, j := range x.currentJobs() {
+		watching, measured := j.readiness()
+		ready = ready && watching && measured
+		if name := j.c.Name; name != "" {
+			_, _ = fmt.Fprintf(&b, "# job: %s\r\n", name)
+		}
+		_, _ = fmt.Fprintf(&b, "ready: %t\r\n"+
+			"# directories watched: %t\r\n"+
+			"# files measured: %t\r\n",
+			watching && measured, watching, measured)
+	}
+	if !ready {
+		http.Error(w, b.String(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, b.String())
+}
+
+// requireMeasured answers 503 instead of calling h until the files of all
+// jobs have been measured for the first time.
+func (x *Exporter) requireMeasured(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, j := range x.currentJobs() {
+			if _, measured := j.readiness(); !measured {
+				http.Error(w, "initial scan not completed", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// readiness reports whether the directories of the job are watched and
+// whether its files have been measured.
+func (j *job) readiness() (watching, measured bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return !j.backendError[backendErrorDirectoryMissing], j.initialized
+}
+
+// startupHandler reports started once the end file of every job has been
+// found, and stays so for good. It is meant as a kubernetes startup probe,
+// which unlike the welpenschutz doesn't need a guess how long that takes.
+func (x *Exporter) startupHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	started := true
+	for _, j := range x.currentJobs() {
+		j.mu.RLock()
+		found := j.endFound
+		j.mu.RUnlock()
+		started = started && found
+		if name := j.c.Name; name != "" {
+			_, _ = fmt.Fprintf(&b, "# job: %s\r\n", name)
+		}
+		_, _ = fmt.Fprintf(&b, "started: %t\r\n", found)
+	}
+	if !started {
+		http.Error(w, b.String(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, b.String())
+}
+
+// Names of the checks as used in logs and the check label.
+const (
+	checkHealth   = "health"
+	checkLiveness = "liveness"
+)
+
+// healthStatus evaluates the health of all jobs.
+func (x *Exporter) healthStatus() []status {
+	jobs := x.currentJobs()
+	sts := make([]status, len(jobs))
+	for i, j := range jobs {
+		sts[i] = j.healthStatus()
+	}
+	return sts
+}
+
+// livenessStatus evaluates the liveness of all jobs.
+func (x *Exporter) livenessStatus() []status {
+	jobs := x.currentJobs()
+	sts := make([]status, len(jobs))
+	for i, j := range jobs {
+		sts[i] = j.livenessStatus()
+	}
+	return sts
+}
+
+// allGood reports whether all jobs are good.
+func allGood(sts []status) bool {
+	for _, st := range sts {
+		if !st.good {
+			return false
+		}
+	}
+	return true
+}
+
+// anyGood reports whether at least one job is good.
+func anyGood(sts []status) bool {
+	for _, st := range sts {
+		if st.good {
+			return true
+		}
+	}
+	return false
+}
+
+// good reports the outcome of a check over all jobs. Health adds up as
+// configured by Config.HealthAggregate, liveness needs all jobs to be good.
+func (x *Exporter) good(sts []status) bool {
+	if x.c.HealthAggregate == HealthAggregateAll && len(sts) > 0 && sts[0].check == checkHealth {
+		return anyGood(sts)
+	}
+	return allGood(sts)
+}
+
+func (j *job) healthStatus() status {
+	remaining := j.welpenschutzRemaining()
+	st := j.evaluate(j.c.HealthTimeout, remaining > 0, j.c.StrictAnomalies)
+	st.check = checkHealth
+	st.remaining = remaining
+	if until, snoozed := j.snoozed(); snoozed {
+		st.snoozed, st.good = until, true
+	}
+	return st
+}
+
+func (j *job) livenessStatus() status {
+	st := j.evaluate(j.c.LivenessTimeout, false, 0)
+	st.check = checkLiveness
+	if j.x.c.LivenessMode == LivenessInternal {
+		// Stale data is up to the health check, restarting won't fix it.
+		st.internal = true
+		st.good = j.loopAlive()
+		st.degraded = false
+	}
+	return st
+}
+
+// transition logs and counts changes of the outcome of check. The first
+// evaluation is not a transition. It is called by checkState, so transitions
+// are noticed without anyone probing.
+func (j *job) transition(check string, st status) {
+	j.mu.Lock()
+	prev, known := j.lastGood[check]
+	j.lastGood[check] = st.good
+	j.mu.Unlock()
+
+	if !known || prev == st.good {
+		return
+	}
+	to := "bad"
+	if st.good {
+		to = "good"
+	}
+	j.promHealthTransitions.WithLabelValues(check, to).Inc()
+	j.x.log.Printf("%s%s changed to %s: end file %s, last update %s, age %s",
+		j.prefix(), check, to, j.endFile, st.end.Format(time.RFC3339Nano), j.x.since(st.end).Round(time.Second))
+}
+
+// welpenschutzOpen is the remaining welpenschutz of modes that don't end
+// after a duration.
+const welpenschutzOpen = time.Duration(math.MaxInt64)
+
+// welpenschutzRemaining returns the remaining initial grace period, 0 if it
+// is over or welpenschutzOpen if it ends with an event.
+func (j *job) welpenschutzRemaining() time.Duration {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	switch j.c.WelpenschutzMode {
+	case WelpenschutzUntilUpdate:
+		if !j.updated {
+			return welpenschutzOpen
+		}
+	case WelpenschutzUntilExists:
+		if j.oldEnd.IsZero() {
+			return welpenschutzOpen
+		}
+	case WelpenschutzIfMissing:
+		if !j.oldEnd.IsZero() {
+			return 0
+		}
+		fallthrough
+	default:
+		if remaining := j.c.Welpenschutz - j.x.since(j.created); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+// evaluate reports good if the last update or acknowledgement is younger
+// than timeout or welpenschutz is active. If strict is positive, strict or
+// more anomalies since the last regular update run report bad regardless of
+// age.
+func (j *job) evaluate(timeout time.Duration, welpenschutz bool, strict int) status {
+	j.mu.RLock()
+	st := status{job: j, end: j.end, acked: j.acked, anomalies: j.anomalies, lastDuration: j.lastDuration}
+	st.vanished = j.backendError[backendErrorDirectoryMissing]
+	j.mu.RUnlock()
+
+	fresh := st.end
+	if st.acked.After(fresh) {
+		fresh = st.acked
+	}
+	updateAge := j.x.since(fresh)
+	st.timeout, st.welpenschutz = timeout, welpenschutz
+	st.state = j.state()
+	st.good = updateAge < timeout && !st.vanished || welpenschutz
+	if strict > 0 && st.anomalies >= strict {
+		st.good = false
+		st.degraded = true
+	}
+	return st
+}
+
+// failed prepares w for a response reporting sts as bad and returns its
+// status code, Config.HealthFailureStatus. Retry-After tells how long it
+// takes until the failing jobs are expected to update, see untilUpdate, or
+// Config.HealthRetryAfter if that can't be told.
+func (x *Exporter) failed(w http.ResponseWriter, sts []status) int {
+	var retry time.Duration
+	for _, st := range sts {
+		if st.good {
+			continue
+		}
+		d, ok := st.job.untilUpdate()
+		if !ok {
+			d = x.c.HealthRetryAfter
+		}
+		retry = max(retry, d)
+	}
+	if retry > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retry.Seconds())), 10))
+	}
+	if x.c.HealthFailureStatus != 0 {
+		return x.c.HealthFailureStatus
+	}
+	return http.StatusServiceUnavailable
+}
+
+// untilUpdate estimates how long it takes until the job updates next: until
+// a running run has taken as long as the last one, or until the interval
+// between the last two runs has passed again. ok is false if there is no
+// estimate, e.g. because the update is overdue.
+func (j *job) untilUpdate() (d time.Duration, ok bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	running := !j.start.IsZero() && (j.end.IsZero() || j.start.After(j.end))
+	switch {
+	case running && j.lastDuration > 0:
+		d = j.lastDuration - j.x.since(j.start)
+	case j.runInterval > 0 && !j.countedEnd.IsZero():
+		d = j.runInterval - j.x.since(j.countedEnd)
+	}
+	return d, d > 0
+}
+
+// writeStatusResponse writes one block per job and reports OK if the jobs
+// are good as a whole, see good. Clients that ask for JSON get JSON.
+func (x *Exporter) writeStatusResponse(w http.ResponseWriter, r *http.Request, sts []status) {
+	if wantsJSON(r) {
+		x.writeJSONResponse(w, sts)
+		return
+	}
+	if r.URL.Query().Has("verbose") {
+		x.writeVerboseResponse(w, sts)
+		return
+	}
+	if x.healthTemplate != nil {
+		x.writeTemplateResponse(w, sts)
+		return
+	}
+
+	var b strings.Builder
+	for _, st := range sts {
+		if name := st.job.c.Name; name != "" {
+			_, _ = fmt.Fprintf(&b, "# job: %s\r\n", name)
+		}
+		age := "never updated"
+		if !st.end.IsZero() {
+			age = x.since(st.end).Round(time.Second).String()
+		}
+		_, _ = fmt.Fprintf(&b, "last_update: %s\r\n"+
+			"# time %s means never.\r\n"+
+			"# alive/healthy: %t\r\n"+
+			"# state: %s\r\n"+
+			"# age: %s, threshold: %s\r\n",
+			st.end.Format(time.RFC3339Nano), time.Time{}, st.good, st.state,
+			age, st.timeout)
+		switch {
+		case st.remaining == welpenschutzOpen && st.job.c.WelpenschutzMode == WelpenschutzUntilUpdate:
+			_, _ = fmt.Fprintf(&b, "# welpenschutz: until the first update run\r\n")
+		case st.remaining == welpenschutzOpen:
+			_, _ = fmt.Fprintf(&b, "# welpenschutz: until the end file exists\r\n")
+		case st.remaining > 0:
+			_, _ = fmt.Fprintf(&b, "# welpenschutz: %s remaining\r\n", st.remaining.Round(time.Second))
+		}
+		if st.acked.After(st.end) {
+			_, _ = fmt.Fprintf(&b, "# acknowledged: %s\r\n", st.acked.Format(time.RFC3339Nano))
+		}
+		if !st.snoozed.IsZero() {
+			_, _ = fmt.Fprintf(&b, "# snoozed: until %s\r\n", st.snoozed.Format(time.RFC3339Nano))
+		}
+		if st.vanished {
+			_, _ = fmt.Fprintf(&b, "# error: a watched directory is missing\r\n")
+		}
+		if st.internal {
+			_, _ = fmt.Fprintf(&b, "# liveness: internal, watch loop alive: %t\r\n", st.good)
+		}
+		if st.degraded {
+			_, _ = fmt.Fprintf(&b, "# degraded: %d anomalies since last update\r\n", st.anomalies)
+		}
+		annotations := st.job.c.Annotations
+		for _, k := range annotations.keys() {
+			_, _ = fmt.Fprintf(&b, "# %s: %s\r\n", k, annotations[k])
+		}
+	}
+	if x.good(sts) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, b.String())
+	} else {
+		http.Error(w, b.String(), x.failed(w, sts))
+	}
+}
+
+// check is a single condition that adds up to a status, as listed by
+// verbose responses.
+type check struct {
+	name   string
+	ok     bool
+	detail string
+}
+
+// checks returns the conditions that st was evaluated from.
+func (x *Exporter) checks(st status) []check {
+	j := st.job
+	j.mu.RLock()
+	statErr := j.backendError[backendErrorStat]
+	j.mu.RUnlock()
+
+	fresh := st.end
+	if st.acked.After(fresh) {
+		fresh = st.acked
+	}
+	age := "never updated"
+	if !fresh.IsZero() {
+		age = "age " + x.since(fresh).Round(time.Second).String()
+	}
+	cs := []check{
+		{"watch_loop", j.loopAlive(), "fs events are being processed"},
+		{"directories", !st.vanished, "the directories of the files are watched"},
+		{"files_readable", !statErr, "the files can be read"},
+	}
+	if st.internal {
+		return cs
+	}
+	cs = append(cs, check{"fresh", !fresh.IsZero() && x.since(fresh) < st.timeout,
+		fmt.Sprintf("%s, threshold %s", age, st.timeout)})
+	if j.c.StrictAnomalies > 0 && st.check == checkHealth {
+		cs = append(cs, check{"anomalies", !st.degraded,
+			fmt.Sprintf("%d anomalies since last update, at most %d", st.anomalies, j.c.StrictAnomalies-1)})
+	}
+	// The welpenschutz passes the check regardless of the others, so it is
+	// only listed while it is active.
+	switch {
+	case !st.welpenschutz:
+	case st.remaining == welpenschutzOpen && j.c.WelpenschutzMode == WelpenschutzUntilUpdate:
+		cs = append(cs, check{"welpenschutz", true, "active until the first update run"})
+	case st.remaining == welpenschutzOpen:
+		cs = append(cs, check{"welpenschutz", true, "active until the end file exists"})
+	default:
+		cs = append(cs, check{"welpenschutz", true, fmt.Sprintf("active, %s remaining", st.remaining.Round(time.Second))})
+	}
+	if !st.snoozed.IsZero() {
+		cs = append(cs, check{"snoozed", true, "until " + st.snoozed.Format(time.RFC3339)})
+	}
+	return cs
+}
+
+// writeVerboseResponse lists the checks of every job with pass or fail per
+// line, like the verbose health endpoints of kubernetes.
+func (x *Exporter) writeVerboseResponse(w http.ResponseWriter, sts []status) {
+	var b strings.Builder
+	for _, st := range sts {
+		prefix := ""
+		if name := st.job.c.Name; name != "" {
+			prefix = name + "/"
+		}
+		for _, c := range x.checks(st) {
+			mark, outcome := "+", "ok"
+			if !c.ok {
+				mark, outcome = "-", "failed"
+			}
+			_, _ = fmt.Fprintf(&b, "[%s]%s%s %s: %s\r\n", mark, prefix, c.name, outcome, c.detail)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if x.good(sts) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(&b, "%s check passed\r\n", checkName(sts))
+	} else {
+		w.WriteHeader(x.failed(w, sts))
+		_, _ = fmt.Fprintf(&b, "%s check failed\r\n", checkName(sts))
+	}
+	_, _ = io.WriteString(w, b.String())
+}
+
+// checkName returns the name of the check that sts are the outcome of.
+func checkName(sts []status) string {
+	if len(sts) == 0 {
+		return checkHealth
+	}
+	return sts[0].check
+}
+
+// wantsJSON reports whether r asks for JSON by the Accept header or the
+// query parameter format=json.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// statusJSON is a job in JSON health and liveness responses. Times and ages
+// are null if the end file never existed.
+type statusJSON struct {
+	Job                string     `json:"job,omitempty"`
+	Check              string     `json:"check"`
+	State              string     `json:"state"`
+	LastUpdate         *time.Time `json:"last_update"`
+	AgeSeconds         *float64   `json:"age_seconds"`
+	ThresholdSeconds   float64    `json:"threshold_seconds"`
+	Healthy            bool       `json:"healthy"`
+	WelpenschutzActive bool       `json:"welpenschutz_active"`
+	// WelpenschutzRemainingSeconds is only set while a welpenschutz that
+	// ends after a duration is active.
+	WelpenschutzRemainingSeconds *float64          `json:"welpenschutz_remaining_seconds,omitempty"`
+	Acknowledged                 *time.Time        `json:"acknowledged,omitempty"`
+	SnoozedUntil                 *time.Time        `json:"snoozed_until,omitempty"`
+	Degraded                     bool              `json:"degraded"`
+	Anomalies                    int               `json:"anomalies"`
+	DirectoryMissing             bool              `json:"directory_missing"`
+	Annotations                  map[string]string `json:"annotations,omitempty"`
+}
+
+// writeJSONResponse writes sts as a JSON object with the overall outcome and
+// one entry per job.
+func (x *Exporter) writeJSONResponse(w http.ResponseWriter, sts []status) {
+	resp := struct {
+		Healthy bool         `json:"healthy"`
+		Jobs    []statusJSON `json:"jobs"`
+	}{Healthy: x.good(sts), Jobs: make([]statusJSON, len(sts))}
+	for i, st := range sts {
+		sj := statusJSON{
+			Job:                st.job.c.Name,
+			Check:              st.check,
+			State:              st.state,
+			ThresholdSeconds:   st.timeout.Seconds(),
+			Healthy:            st.good,
+			WelpenschutzActive: st.welpenschutz,
+			Degraded:           st.degraded,
+			Anomalies:          st.anomalies,
+			DirectoryMissing:   st.vanished,
+			Annotations:        st.job.c.Annotations,
+		}
+		if !st.end.IsZero() {
+			end, age := st.end, x.since(st.end).Seconds()
+			sj.LastUpdate, sj.AgeSeconds = &end, &age
+		}
+		if st.remaining > 0 && st.remaining != welpenschutzOpen {
+			remaining := st.remaining.Seconds()
+			sj.WelpenschutzRemainingSeconds = &remaining
+		}
+		if st.acked.After(st.end) {
+			acked := st.acked
+			sj.Acknowledged = &acked
+		}
+		if !st.snoozed.IsZero() {
+			snoozed := st.snoozed
+			sj.SnoozedUntil = &snoozed
+		}
+		resp.Jobs[i] = sj
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(x.failed(w, sts))
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (x *Exporter) writeTemplateResponse(w http.ResponseWriter, sts []status) {
+	hostname, _ := os.Hostname()
+	var b bytes.Buffer
+	for _, st := range sts {
+		remaining := st.remaining
+		if remaining == welpenschutzOpen {
+			remaining = 0
+		}
+		data := healthTemplateData{
+			Job:                   st.job.c.Name,
+			Check:                 st.check,
+			State:                 st.state,
+			File:                  st.job.endFile,
+			LastUpdate:            st.end,
+			Age:                   x.since(st.end),
+			Threshold:             st.timeout,
+			Healthy:               st.good,
+			Welpenschutz:          st.welpenschutz,
+			WelpenschutzRemaining: remaining,
+			SnoozedUntil:          st.snoozed,
+			Degraded:              st.degraded,
+			Anomalies:             st.anomalies,
+			LastDuration:          st.lastDuration,
+			Hostname:              hostname,
+			Annotations:           st.job.c.Annotations,
+		}
+		if err := x.healthTemplate.Execute(&b, data); err != nil {
+			x.log.Printf("Error executing health template: %v", err)
+			http.Error(w, "error executing health template", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if x.good(sts) {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(x.failed(w, sts))
+	}
+	_, _ = b.WriteTo(w)
+}
@@ -0,0 +1,104 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Patterns leave files out of glob matches and of recursive trees, so editor
+// temp files and partial uploads don't count as updates. A pattern is a glob
+// of base names, like "*.tmp" or ".*", or, prefixed with "re:", a regular
+// expression matched against the slash separated path, like "re:/\.git$".
+// Ignored directories are left out with everything beneath them. It
+// implements flag.Value and is set from a comma separated list.
+type Patterns []string
+
+// regexPrefix marks a pattern as regular expression.
+const regexPrefix = "re:"
+
+// regexps caches the compiled regular expressions of patterns, as they are
+// matched on every file of a tree.
+var regexps sync.Map // string → *regexp.Regexp
+
+func (p *Patterns) String() string {
+	if p == nil {
+		return ""
+	}
+	return strings.Join(*p, ",")
+}
+
+func (p *Patterns) Set(s string) error {
+	var ps Patterns
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			ps = append(ps, f)
+		}
+	}
+	if err := ps.validate(); err != nil {
+		return err
+	}
+	*p = ps
+	return nil
+}
+
+// validate returns an error for the first malformed pattern.
+func (p Patterns) validate() error {
+	for _, pattern := range p {
+		var err error
+		if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+			_, err = regexp.Compile(expr)
+		} else {
+			_, err = filepath.Match(pattern, "")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid ignore pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// match reports whether path matches any of the patterns.
+func (p Patterns) match(path string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range p {
+		if expr, ok := strings.CutPrefix(pattern, regexPrefix); ok {
+			if re := compileRegexp(expr); re != nil && re.MatchString(filepath.ToSlash(path)) {
+				return true
+			}
+		} else if matched, _ := filepath.Match(pattern, base); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// compileRegexp returns the compiled expr, or nil if it is invalid, which
+// validate has ruled out.
+func compileRegexp(expr string) *regexp.Regexp {
+	if re, ok := regexps.Load(expr); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil
+	}
+	regexps.Store(expr, re)
+	return re
+}
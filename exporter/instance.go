@@ -0,0 +1,123 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// instanceInfo is the fileage_exporter_instance_info metric that identifies
+// the host the exporter runs on. The fqdn is resolved in the background, so
+// a slow DNS doesn't hold up New; until then it is the hostname.
+type instanceInfo struct {
+	desc     *prometheus.Desc
+	hostname string
+
+	mu   sync.Mutex
+	fqdn string
+}
+
+func newInstanceInfo() prometheus.Collector {
+	hostname, _ := os.Hostname()
+	i := &instanceInfo{
+		desc: prometheus.NewDesc("fileage_exporter_instance_info",
+			"Information about the host the exporter runs on.",
+			[]string{"hostname", "fqdn"}, nil),
+		hostname: hostname,
+		fqdn:     hostname,
+	}
+	go func() {
+		name := fqdn(hostname)
+		i.mu.Lock()
+		i.fqdn = name
+		i.mu.Unlock()
+	}()
+	return i
+}
+
+func (i *instanceInfo) Describe(ch chan<- *prometheus.Desc) {
+	ch <- i.desc
+}
+
+func (i *instanceInfo) Collect(ch chan<- prometheus.Metric) {
+	i.mu.Lock()
+	fqdn := i.fqdn
+	i.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(i.desc, prometheus.GaugeValue, 1, i.hostname, fqdn)
+}
+
+// fqdn resolves the fully qualified name of hostname, falling back to
+// hostname itself if it can't be resolved quickly.
+func fqdn(hostname string) string {
+	if hostname == "" {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	cname, err := net.DefaultResolver.LookupCNAME(ctx, hostname)
+	if err != nil || cname == "" {
+		return hostname
+	}
+	return strings.TrimSuffix(cname, ".")
+}
+
+// Version is the version of the exporter. It is set at build time with
+// -ldflags "-X github.com/jwkohnen/prometheus_fileage_exporter/exporter.Version=v1.2.3"
+// and otherwise taken from the module version, if any.
+var Version string
+
+// BuildInfo returns the version, VCS revision and Go version the exporter
+// was built with. Unknown values are empty.
+func BuildInfo() (version, revision, goVersion string) {
+	version, goVersion = Version, runtime.Version()
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version, "", goVersion
+	}
+	if version == "" && bi.Main.Version != "(devel)" {
+		version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			revision = s.Value
+		}
+	}
+	return version, revision, goVersion
+}
+
+// newBuildInfo returns the constant fileage_exporter_build_info metric.
+func newBuildInfo() prometheus.Collector {
+	version, revision, goVersion := BuildInfo()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fileage_exporter_build_info",
+		Help: "Version, revision and Go version the exporter was built with.",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"revision":  revision,
+			"goversion": goVersion,
+		},
+	})
+	g.Set(1)
+	return g
+}
@@ -0,0 +1,1163 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// job monitors one start/end file pair.
+type job struct {
+	x                         *Exporter
+	c                         Job
+	startFile                 string
+	endFile                   string
+	phaseFiles                []string
+	registerer                prometheus.Registerer
+	collectors                []prometheus.Collector
+	registerErr               error // first failed registration
+	created                   time.Time
+	done                      chan struct{}
+	loops                     sync.WaitGroup // goroutines stopped by done
+	watchers                  []watcher
+	appeared                  chan struct{} // a missing directory is watched now
+	tree                      treeState     // owned by the watch loop
+	promUpdateCount           prometheus.Counter
+	promUpdateStarted         prometheus.Counter
+	promUpdateAge             prometheus.Gauge
+	promUpdateRunning         prometheus.Gauge
+	promRunElapsed            prometheus.Gauge
+	promUpdateDuration        durationObserver
+	promUpdateAnomalies       *prometheus.CounterVec
+	promDirectoryRetries      prometheus.Counter
+	promImplausibleDuration   prometheus.Counter
+	promEndHeartbeats         prometheus.Counter
+	promHealthTransitions     *prometheus.CounterVec
+	promUpdateState           *prometheus.GaugeVec
+	promLastDuration          prometheus.Gauge
+	promLastRunStart          prometheus.Gauge
+	promLastRunEnd            prometheus.Gauge
+	promNewestMatch           *prometheus.GaugeVec
+	promTreeFiles             prometheus.Gauge
+	promTreeSize              prometheus.Gauge
+	promTreeOldest            *prometheus.GaugeVec
+	promTreeLargest           *prometheus.GaugeVec
+	promFileMtime             *prometheus.GaugeVec
+	promFileExists            *prometheus.GaugeVec
+	promFileSize              *prometheus.GaugeVec
+	promWelpenschutzRemaining prometheus.Gauge
+	promAcknowledged          *prometheus.GaugeVec
+	promAcknowledgedTime      prometheus.Gauge
+	promSnoozed               prometheus.Gauge
+	promPhaseCompleted        *prometheus.GaugeVec
+	promPhaseDuration         *prometheus.GaugeVec
+	promLastOutputRows        prometheus.Gauge
+	promConfigError           *prometheus.GaugeVec
+	promBackendError          *prometheus.GaugeVec
+	promCollectionSuccess     prometheus.Gauge
+	promMtimeResolution       *prometheus.GaugeVec
+	slo                       *slo
+
+	mu           sync.RWMutex
+	start        time.Time
+	end          time.Time
+	oldEnd       time.Time
+	oldStart     time.Time
+	startSeen    time.Time // when the start file last changed, by the exporter's clock
+	countedEnd   time.Time // mtime of the end file of the last counted run
+	lastRunStart time.Time // mtime of the start file of the last counted run
+	resumed      bool      // from the state file
+	initialized  bool
+	endFound     bool // the end file has been found once, see startupHandler
+	anomalies    int  // since the last regular update run
+	updated      bool
+	lastGood     map[string]bool // by check
+	lastDuration time.Duration
+	durationSet  bool                     // lastDuration is of a run, see scrapeCollector
+	runInterval  time.Duration            // between the ends of the last two counted runs
+	heartbeat    time.Time                // of the watch loop, by the real clock
+	acked        time.Time                // treated as fresh as of then, see acknowledge
+	snoozedUntil time.Time                // see snooze
+	lastState    string                   // as of the last checkState
+	backendError map[string]bool          // by reason
+	mtimeRes     map[string]time.Duration // by role, see observeResolution
+	progressRun  time.Time                // start of the run that checkpoints counts for
+	checkpoints  int                      // Job.RunCheckpoint intervals progressRun passed
+}
+
+// The watch loop beats every heartbeatInterval and is considered stalled
+// after heartbeatTimeout without a beat.
+const (
+	heartbeatInterval = 5 * time.Second
+	heartbeatTimeout  = 30 * time.Second
+)
+
+// Reasons of config_error_info and backend_error_info.
+const (
+	configErrorSameFiles         = "same_files"
+	configErrorReload            = "reload_failed"
+	configErrorOverlap           = "overlapping_watch"
+	backendErrorDirectoryMissing = "directory_missing"
+	backendErrorStat             = "stat"
+	backendErrorRetriesExhausted = "retries_exhausted"
+)
+
+// maxAwaitBackoff caps the delay between attempts to watch a missing
+// directory with AllowMissingTargets, which are retried indefinitely unless
+// RetryPolicy.MaxAttempts limits them.
+const maxAwaitBackoff = time.Minute
+
+// Kinds of anomalies counted by update_anomalies_total.
+const (
+	anomalyEndBackwards     = "end_backwards"
+	anomalyStartAfterEnd    = "start_after_end"
+	anomalyEndBeforeStartup = "end_before_startup"
+)
+
+// newJob creates the metrics of job c, registers them and starts watching
+// the files. all are all configured jobs, including c.
+func newJob(x *Exporter, c Job, all []Job) (*job, error) {
+	ns, sub := x.c.Namespace, x.c.Subsystem
+	reg := jobRegisterer(x.tenantRegisterer(c.Tenant), c, all)
+	j := &job{
+		x:            x,
+		c:            c,
+		registerer:   reg,
+		created:      x.now(),
+		done:         make(chan struct{}),
+		appeared:     make(chan struct{}, 1),
+		backendError: make(map[string]bool),
+		mtimeRes:     make(map[string]time.Duration),
+		lastGood:     make(map[string]bool),
+		promUpdateCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "update_count_total",
+			Help:      "Counter of update runs.",
+		}),
+		promUpdateStarted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "update_started_total",
+			Help:      "Counter of started update runs.",
+		}),
+		promUpdateAge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "update_age_seconds",
+			Help:      "Time since last time an update finished.",
+		}),
+		promUpdateRunning: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "update_running",
+			Help:      "If the monitored process seems to run: 0 no; 1 yes.",
+		}),
+		promRunElapsed: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "current_run_elapsed_seconds",
+			Help:      "How long the update run in progress has been running, 0 if none is.",
+		}),
+		promUpdateDuration: newDurationObserver(x.c, ns, sub),
+		promUpdateAnomalies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "update_anomalies_total",
+			Help:      "Counter of end file changes that were not counted as update runs, by kind.",
+		}, []string{"kind"}),
+		promDirectoryRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "directory_add_retries_total",
+			Help:      "Counter of retries to watch a directory that could not be watched.",
+		}),
+		promImplausibleDuration: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "implausible_duration_total",
+			Help:      "Counter of update runs with a duration out of the configured bounds.",
+		}),
+		promEndHeartbeats: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "end_heartbeats_total",
+			Help:      "Counter of end file changes without an open update run, which only refresh the age.",
+		}),
+		promHealthTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "health_transitions_total",
+			Help:      "Counter of changes of the health and liveness outcome, by check and new outcome.",
+		}, []string{"check", "to"}),
+		promUpdateState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "update_state",
+			Help:      "Current state of the monitored process: 1 for the current state, 0 for all others.",
+		}, []string{"state"}),
+		promLastDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "last_update_duration_seconds",
+			Help:      "Duration of the most recent update run in seconds.",
+		}),
+		promLastRunStart: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "last_run_start_timestamp_seconds",
+			Help:      "Start time of the most recent update run since unix epoch in seconds.",
+		}),
+		promLastRunEnd: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "last_run_end_timestamp_seconds",
+			Help:      "End time of the most recent update run since unix epoch in seconds.",
+		}),
+		promNewestMatch: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "glob_newest_match_info",
+			Help:      "The newest file matching a glob pattern for the start or end file, by role and path.",
+		}, []string{"role", "path"}),
+		promFileMtime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "file_mtime_timestamp_seconds",
+			Help:      "Modification time of the monitored files since unix epoch in seconds, by path.",
+		}, []string{"path"}),
+		promFileExists: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "file_exists",
+			Help:      "If the monitored file exists, or for patterns if any file matches: 0 no; 1 yes; by path.",
+		}, []string{"path"}),
+		promTreeFiles: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "tree_files",
+			Help:      "Number of files in the end file tree.",
+		}),
+		promTreeSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "tree_size_bytes",
+			Help:      "Total size of the files in the end file tree.",
+		}),
+		promTreeOldest: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "tree_oldest_file_mtime_timestamp_seconds",
+			Help:      "Modification time of the oldest files in the end file tree since unix epoch in seconds, by rank and path.",
+		}, []string{"rank", "path"}),
+		promTreeLargest: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "tree_largest_file_size_bytes",
+			Help:      "Size of the largest files in the end file tree, by rank and path.",
+		}, []string{"rank", "path"}),
+		promFileSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "file_size_bytes",
+			Help:      "Size of the monitored files, or for patterns of the newest match, by path.",
+		}, []string{"path"}),
+		promConfigError: newConfigErrorVec(ns, sub),
+		promBackendError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "backend_error_info",
+			Help:      "Present with value 1 while the monitored files can't be watched or read, by reason.",
+		}, []string{"reason"}),
+		promCollectionSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "collection_success",
+			Help:      "1 if the monitored files could be watched and read on the last attempt, 0 otherwise.",
+		}),
+		promMtimeResolution: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "mtime_resolution_seconds",
+			Help:      "Detected mtime resolution of the file system of the start or end file.",
+		}, []string{"role"}),
+		promWelpenschutzRemaining: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "welpenschutz_remaining_seconds",
+			Help:      "Remaining initial grace period of the health check in seconds, +Inf until the first update or end file if so configured.",
+		}),
+		promLastOutputRows: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "last_output_rows",
+			Help:      "Number of lines of the end file when it last changed, NaN if it could not be counted.",
+		}),
+		promAcknowledged: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "update_acknowledged_info",
+			Help:      "Who acknowledged the monitored process as fresh the last time and why.",
+		}, []string{"by", "reason"}),
+		promAcknowledgedTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "update_acknowledged_timestamp_seconds",
+			Help:      "Time of the last acknowledgement since unix epoch in seconds.",
+		}),
+		promSnoozed: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "snoozed",
+			Help:      "1 while the job is snoozed, else 0.",
+		}),
+	}
+	for _, kind := range []string{anomalyEndBackwards, anomalyStartAfterEnd, anomalyEndBeforeStartup} {
+		j.promUpdateAnomalies.WithLabelValues(kind)
+	}
+	for _, check := range []string{checkHealth, checkLiveness} {
+		j.promHealthTransitions.WithLabelValues(check, "good")
+		j.promHealthTransitions.WithLabelValues(check, "bad")
+	}
+	j.setState(StateUnknown)
+	j.lastState = StateUnknown
+	j.slo = newSLO(ns, sub, j.created)
+	j.register(j.promUpdateCount, j.promUpdateAnomalies, j.promDirectoryRetries, j.promHealthTransitions, j.promFileMtime, j.promFileExists, j.promFileSize, j.promConfigError, j.promBackendError, j.promCollectionSuccess, j.promMtimeResolution, j.promAcknowledged, j.promAcknowledgedTime)
+	j.promCollectionSuccess.Set(1)
+	if labels := annotationLabels(c, all); len(labels) > 0 {
+		info := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   ns,
+			Subsystem:   sub,
+			Name:        "update_info",
+			Help:        "Annotations of the monitored process as labels.",
+			ConstLabels: labels,
+		})
+		info.Set(1)
+		j.register(info)
+	}
+	if c.StartFile != "" {
+		j.register(j.promUpdateStarted, j.promUpdateRunning, j.promUpdateDuration)
+	}
+	if c.StartFile != "" && (c.MinDuration > 0 || c.MaxDuration > 0) {
+		j.register(j.promImplausibleDuration)
+	}
+	if c.EndRequiresStart {
+		j.register(j.promEndHeartbeats)
+	}
+	if c.TopFiles > 0 {
+		j.register(j.promTreeFiles, j.promTreeSize, j.promTreeOldest, j.promTreeLargest)
+	}
+	if isGlob(c.StartFile) || isGlob(c.EndFile) || c.EndRecursive {
+		j.register(j.promNewestMatch)
+	}
+	if c.CountRowsMaxSize > 0 {
+		j.register(j.promLastOutputRows)
+	}
+	if len(c.Phases) > 0 {
+		j.promPhaseCompleted, j.promPhaseDuration = newPhaseMetrics(ns, sub)
+	}
+	j.register(newScrapeCollector(j))
+	if j.registerErr != nil {
+		j.close()
+		return nil, &ConfigError{Job: c.Name, Err: fmt.Errorf("registering metrics: %w", j.registerErr)}
+	}
+
+	logger := x.log
+	var err error
+	j.startFile, j.endFile, err = c.resolve()
+	if err != nil {
+		j.close()
+		return nil, &ConfigError{Job: c.Name, Err: err}
+	}
+	// resolve has validated the phases.
+	j.phaseFiles, _ = c.Phases.resolve()
+	if j.startFile == j.endFile {
+		// Every event would count as both start and end of a run; resolve
+		// refuses this with strict anomalies.
+		logger.Printf("%sWarning: start and end file are the same: %s", j.prefix(), j.endFile)
+		j.setConfigError(configErrorSameFiles, true)
+	}
+	if overlap := c.overlap(all); overlap != "" {
+		// LoadJobs refuses this with strict anomalies.
+		logger.Printf("%sWarning: %s", j.prefix(), overlap)
+		j.setConfigError(configErrorOverlap, true)
+	}
+
+	if c.SyntheticInterval > 0 {
+		j.synthesize()
+	}
+	startWatcher, err := j.createWatcher(j.startFile, false)
+	if err != nil {
+		j.close()
+		return nil, err
+	}
+	endWatcher, err := j.createWatcher(j.endFile, c.EndRecursive)
+	if err != nil {
+		j.close()
+		return nil, err
+	}
+	if st, ok := x.savedState(c.Name); ok {
+		j.restore(st)
+	}
+	j.watch(startWatcher, endWatcher)
+
+	return j, nil
+}
+
+// resolve validates c and returns the resolved start and end file.
+func (c Job) resolve() (startFile, endFile string, err error) {
+	if c.StartFile != "" {
+		startFile, err = resolvePath(c.StartFile)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if c.EndFile == "" {
+		return "", "", errors.New("end file must be set")
+	}
+	switch c.WelpenschutzMode {
+	case "", WelpenschutzDuration, WelpenschutzUntilUpdate, WelpenschutzUntilExists, WelpenschutzIfMissing:
+	default:
+		return "", "", fmt.Errorf("unknown welpenschutz mode %q", c.WelpenschutzMode)
+	}
+	if c.EndRequiresStart && c.StartFile == "" {
+		return "", "", errors.New("end file requiring a start needs a start file")
+	}
+	switch c.DurationSource {
+	case "", DurationMtime, DurationEvents:
+	default:
+		return "", "", fmt.Errorf("unknown duration source %q", c.DurationSource)
+	}
+	switch c.DirectoryRemoved {
+	case "", DirectoryRemovedError, DirectoryRemovedStale:
+	default:
+		return "", "", fmt.Errorf("unknown directory removed mode %q", c.DirectoryRemoved)
+	}
+	endFile, err = resolvePath(c.EndFile)
+	if err != nil {
+		return "", "", err
+	}
+	if err := c.Ignore.validate(); err != nil {
+		return "", "", err
+	}
+	if c.Tenant != "" && !validTenantName(c.Tenant) {
+		return "", "", fmt.Errorf("invalid tenant name %q", c.Tenant)
+	}
+	if c.TopFiles > 0 && !c.EndRecursive {
+		return "", "", errors.New("top files are only supported in recursive mode")
+	}
+	if c.EndRecursive && isGlob(endFile) {
+		return "", "", fmt.Errorf("glob patterns are not supported in recursive mode: %s", endFile)
+	}
+	for _, file := range []string{startFile, endFile} {
+		if isGlob(filepath.Dir(file)) {
+			return "", "", fmt.Errorf("glob patterns are only supported in the file name, not the directory: %s", file)
+		}
+	}
+	if c.SyntheticInterval > 0 {
+		if isGlob(endFile) || c.EndRecursive {
+			return "", "", errors.New("synthetic runs need a plain end file")
+		}
+		if c.SyntheticDuration >= c.SyntheticInterval {
+			return "", "", errors.New("synthetic run duration must be shorter than the interval")
+		}
+	}
+	if _, err := c.Phases.resolve(); err != nil {
+		return "", "", err
+	}
+	if startFile == endFile && c.StrictAnomalies > 0 {
+		return "", "", fmt.Errorf("start and end file are the same: %s", endFile)
+	}
+	return startFile, endFile, nil
+}
+
+// sameFiles reports whether c resolves to the files j watches. Paths with
+// templates may resolve differently than when j was created, e.g. on
+// another day.
+func (j *job) sameFiles(c Job) bool {
+	start, end, err := c.resolve()
+	if err != nil {
+		return false
+	}
+	phases, _ := c.Phases.resolve()
+	return start == j.startFile && end == j.endFile && slices.Equal(phases, j.phaseFiles)
+}
+
+// overlap describes how the files of c overlap with those of another of
+// jobs, empty if they don't. A file watched by two jobs has its updates
+// counted twice, and so do nested recursive trees.
+func (c Job) overlap(jobs []Job) string {
+	type watched struct {
+		role, path string
+		tree       bool
+	}
+	files := func(c Job) []watched {
+		start, end, err := c.resolve()
+		if err != nil {
+			// Reported by resolve elsewhere.
+			return nil
+		}
+		ws := []watched{{"end", end, c.EndRecursive}}
+		if start != "" {
+			ws = append(ws, watched{"start", start, false})
+		}
+		return ws
+	}
+	mine := files(c)
+	for _, other := range jobs {
+		if other.Name == c.Name {
+			continue
+		}
+		for _, a := range mine {
+			for _, b := range files(other) {
+				switch {
+				case a.path == b.path:
+					return fmt.Sprintf("%s file %s is also watched by job %q", a.role, a.path, other.Name)
+				case a.tree && withinRoots([]string{a.path}, b.path):
+					return fmt.Sprintf("%s file %s of job %q is in the tree %s", b.role, b.path, other.Name, a.path)
+				case b.tree && withinRoots([]string{b.path}, a.path):
+					return fmt.Sprintf("%s file %s is in the tree %s of job %q", a.role, a.path, b.path, other.Name)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// register registers metrics of the job, remembering them for close. After
+// the first failure it registers nothing more and keeps the error in
+// registerErr.
+func (j *job) register(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if j.registerErr != nil {
+			return
+		}
+		if err := j.registerer.Register(c); err != nil {
+			j.registerErr = err
+			return
+		}
+		j.collectors = append(j.collectors, c)
+	}
+}
+
+// close stops watching and unregisters the job's metrics. It returns once
+// the goroutines of the job have finished.
+func (j *job) close() {
+	close(j.done)
+	j.loops.Wait()
+	for _, w := range j.watchers {
+		_ = w.Close()
+	}
+	for _, c := range j.collectors {
+		j.registerer.Unregister(c)
+	}
+}
+
+// jobRegisterer returns the registerer for the metrics of c, wrapping base. Jobs from a
+// config file get their name and labels as constant labels. As all metrics
+// of the same name must have the same label names, labels that only other
+// jobs have are set to the empty string, which prometheus treats as absent.
+func jobRegisterer(base prometheus.Registerer, c Job, all []Job) prometheus.Registerer {
+	if c.Name == "" {
+		return base
+	}
+	labels := prometheus.Labels{jobLabel: c.Name}
+	for _, other := range all {
+		for k := range other.Labels {
+			labels[k] = ""
+		}
+	}
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	return prometheus.WrapRegistererWith(labels, base)
+}
+
+// annotationLabels returns the labels of update_info for c, padded with the
+// annotation keys of all other jobs for the same reason as in jobRegisterer.
+// It is empty if no job has annotations.
+func annotationLabels(c Job, all []Job) prometheus.Labels {
+	labels := make(prometheus.Labels)
+	for _, other := range all {
+		for k := range other.Annotations {
+			labels[k] = ""
+		}
+	}
+	for k, v := range c.Annotations {
+		labels[k] = v
+	}
+	return labels
+}
+
+// prefix is prepended to log messages to tell jobs apart. It is empty for
+// the job configured by flags.
+func (j *job) prefix() string {
+	if j.c.Name == "" {
+		return ""
+	}
+	return "[" + j.c.Name + "] "
+}
+
+// resolvePath expands templates in name and makes it absolute.
+func resolvePath(name string) (string, error) {
+	name, err := expandPath(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(name)
+}
+
+// createWatcher watches the directory of filename, or if tree is set the
+// directory filename and all directories beneath it.
+func (j *job) createWatcher(filename string, tree bool) (watcher, error) {
+	if filename == "" {
+		// return a watcher that will block forever
+		return notifyWatcher{&fsnotify.Watcher{}}, nil
+	}
+
+	w, err := j.x.newWatcher()
+	if err != nil {
+		return nil, &WatchError{Job: j.c.Name, Path: filename, Err: err}
+	}
+	j.watchers = append(j.watchers, w)
+	dir := watchDir(filename, tree)
+	if j.x.c.AllowMissingTargets {
+		if err := w.Add(dir); err != nil {
+			j.x.log.Printf("%sDirectory \"%s\" is missing, watching it once it appears: %v", j.prefix(), dir, err)
+			j.mu.Lock()
+			j.setBackendError(backendErrorDirectoryMissing, true)
+			j.mu.Unlock()
+			j.loops.Add(1)
+			go j.awaitDirectory(w, dir, tree)
+			return w, nil
+		}
+		if tree {
+			j.addTree(w, dir)
+		}
+		return w, nil
+	}
+	deadline := time.NewTimer(time.Until(j.created.Add(j.x.c.DirectoryTimeout)))
+retry:
+	for attempt := 0; ; attempt++ {
+		addErr := w.Add(dir)
+		if addErr == nil {
+			break retry
+		}
+		if j.x.c.DirectoryRetry.exhausted(attempt) {
+			return nil, &WatchError{Job: j.c.Name, Path: dir, Err: fmt.Errorf("%w: %v", ErrRetriesExhausted, addErr)}
+		}
+		backoff := j.x.c.DirectoryRetry.delay(attempt)
+		select {
+		case <-time.After(backoff):
+			j.x.log.Printf("%sRetrying to add directory \"%s\" in %s after error: %v", j.prefix(), dir, backoff, addErr)
+			j.promDirectoryRetries.Inc()
+			continue retry
+		case <-deadline.C:
+			return nil, &WatchError{Job: j.c.Name, Path: dir, Err: fmt.Errorf("%w: %v", ErrDirectoryTimeout, addErr)}
+		}
+	}
+	if tree {
+		j.addTree(w, dir)
+	}
+	return w, nil
+}
+
+// watchDir returns the directory that is watched for filename.
+func watchDir(filename string, tree bool) string {
+	if tree {
+		return filename
+	}
+	return filepath.Dir(filename)
+}
+
+// directoryRemoved reports whether e is the removal of the watched directory
+// dir. If so, the job reports a backend error until dir is watched again
+// once it reappears. Renaming dir counts as removal, as its files are no
+// longer where they are expected.
+func (j *job) directoryRemoved(w watcher, e fsnotify.Event, dir string, tree bool) bool {
+	if e.Name != dir || !e.Has(fsnotify.Remove) && !e.Has(fsnotify.Rename) {
+		return false
+	}
+	j.x.log.Printf("%sDirectory \"%s\" vanished, watching it once it reappears", j.prefix(), dir)
+	// A renamed directory is still watched under its new name.
+	_ = w.Remove(dir)
+	j.mu.Lock()
+	j.setBackendError(backendErrorDirectoryMissing, true)
+	j.mu.Unlock()
+	j.loops.Add(1)
+	go j.awaitDirectory(w, dir, tree)
+	return true
+}
+
+// awaitDirectory adds dir to w once it appears and triggers an update.
+func (j *job) awaitDirectory(w watcher, dir string, tree bool) {
+	defer j.loops.Done()
+	policy := j.x.c.DirectoryRetry
+	if policy.MaxBackoff <= 0 || policy.MaxBackoff > maxAwaitBackoff {
+		policy.MaxBackoff = maxAwaitBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		if policy.exhausted(attempt) {
+			j.x.log.Printf("%sGiving up on directory \"%s\" after %d retries", j.prefix(), dir, attempt)
+			j.mu.Lock()
+			j.setBackendError(backendErrorRetriesExhausted, true)
+			j.mu.Unlock()
+			return
+		}
+		select {
+		case <-time.After(policy.delay(attempt)):
+		case <-j.done:
+			return
+		}
+		j.promDirectoryRetries.Inc()
+		if err := w.Add(dir); err != nil {
+			continue
+		}
+		j.x.log.Printf("%sDirectory \"%s\" appeared, watching it now", j.prefix(), dir)
+		j.mu.Lock()
+		j.setBackendError(backendErrorDirectoryMissing, false)
+		j.mu.Unlock()
+		if tree {
+			j.addTree(w, dir)
+		}
+		select {
+		case j.appeared <- struct{}{}:
+		default:
+		}
+		return
+	}
+}
+
+func (j *job) watch(startWatcher, endWatcher watcher) {
+	j.beat()
+	j.loops.Add(1)
+	go func() {
+		defer j.loops.Done()
+		defer j.x.reporter.reportPanic(j)
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		rescan := j.firstRescan()
+		j.tree.walk = true
+		j.update(nil)
+		for {
+			select {
+			case <-heartbeat.C:
+				j.beat()
+				if j.tree.statsStale {
+					j.tree.walk = true
+					j.update(nil)
+				}
+				j.checkState()
+				j.checkProgress()
+			case <-j.appeared:
+				j.tree.walk = true
+				j.update(nil)
+			case <-rescan:
+				j.tree.walk = true
+				j.update(&pacer{})
+				rescan = time.After(jitter(j.c.RescanInterval, rescanJitter))
+			case <-j.done:
+				return
+			case e := <-startWatcher.eventChan():
+				delayEvent()
+				if j.directoryRemoved(startWatcher, e, watchDir(j.startFile, false), false) {
+					j.update(nil)
+				} else if matchBase(j.startFile, e.Name) && j.c.StartEvents.match(e.Op) {
+					j.update(nil)
+				}
+			case e := <-endWatcher.eventChan():
+				delayEvent()
+				if j.directoryRemoved(endWatcher, e, watchDir(j.endFile, j.c.EndRecursive), j.c.EndRecursive) {
+					j.tree.walk = true
+					j.update(nil)
+				} else if j.c.EndRecursive {
+					j.treeEvent(endWatcher, e)
+					if j.c.EndEvents.match(e.Op) && !j.c.Ignore.match(e.Name) {
+						j.treeChanged(e)
+						j.update(nil)
+					}
+				} else if matchBase(j.endFile, e.Name) && j.c.EndEvents.match(e.Op) {
+					j.update(nil)
+				}
+			case err := <-startWatcher.errorChan():
+				j.x.log.Printf("%sError waiting for fs event on start file: %v", j.prefix(), err)
+				j.x.reporter.report(j, fmt.Sprintf("Error waiting for fs event on start file: %v", err))
+			case err := <-endWatcher.errorChan():
+				j.x.log.Printf("%sError waiting for fs event on end file: %v", j.prefix(), err)
+				j.x.reporter.report(j, fmt.Sprintf("Error waiting for fs event on end file: %v", err))
+			}
+		}
+	}()
+}
+
+// beat records that the watch loop is alive.
+func (j *job) beat() {
+	j.mu.Lock()
+	j.heartbeat = time.Now()
+	j.mu.Unlock()
+}
+
+// loopAlive reports whether the watch loop has beaten recently.
+func (j *job) loopAlive() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return time.Since(j.heartbeat) < heartbeatTimeout
+}
+
+// measure returns the mtime of filename, or if filename is a glob pattern
+// the mtime of its newest match that isn't ignored, along with the path it
+// measured. In case of error or if nothing matches returns zero time.Time.
+// err is the first error other than a missing file. pace paces the stat
+// calls.
+func measure(filename string, ignore Patterns, pace *pacer) (mtime time.Time, path string, err error) {
+	if filename == "" {
+		return
+	}
+	if !isGlob(filename) {
+		fi, statErr := stat(filename)
+		if statErr != nil {
+			return time.Time{}, "", ignoreNotExist(statErr)
+		}
+		return fi.ModTime(), filename, nil
+	}
+	matches, _ := filepath.Glob(filename)
+	for _, m := range matches {
+		if ignore.match(m) {
+			continue
+		}
+		pace.step()
+		fi, statErr := stat(m)
+		if statErr != nil {
+			if err == nil {
+				err = ignoreNotExist(statErr)
+			}
+			continue
+		}
+		if fi.IsDir() {
+			continue
+		}
+		if fi.ModTime().After(mtime) {
+			mtime, path = fi.ModTime(), m
+		}
+	}
+	return
+}
+
+// fileSize returns the size of the file at path, or -1 if there is none.
+func fileSize(path string) int64 {
+	if path == "" {
+		return -1
+	}
+	fi, err := stat(path)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+// ignoreNotExist returns err unless it reports a missing file, which is a
+// regular state of monitored files.
+func ignoreNotExist(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// isGlob reports whether name contains glob meta characters.
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// matchBase reports whether the base name of the event path name matches
+// the base name of the watched file, which may be a glob pattern.
+func matchBase(file, name string) bool {
+	matched, _ := filepath.Match(filepath.Base(file), filepath.Base(name))
+	return matched
+}
+
+func (j *job) update(pace *pacer) {
+	j.accountSLO()
+	start, startPath, startErr := measure(j.startFile, j.c.Ignore, pace)
+	var end time.Time
+	var endPath string
+	var endErr error
+	var stats *treeStats
+	if j.c.EndRecursive {
+		end, endPath, stats, endErr = j.newestInTree(pace)
+	} else {
+		end, endPath, endErr = measure(j.endFile, j.c.Ignore, pace)
+	}
+	j.countRows(end, endPath)
+	startSize, endSize := fileSize(startPath), fileSize(endPath)
+
+	var notes []Notification
+	var changed bool
+	defer func() {
+		if changed {
+			j.x.stateChanged()
+		}
+		j.notify(notes...)
+		j.checkState()
+	}()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	changed = !start.Equal(j.oldStart) || !end.Equal(j.oldEnd)
+
+	// The files found at startup are history, not anomalies, unless they
+	// changed since the state was saved.
+	initial := !j.initialized
+	j.initialized = true
+	resumed := initial && j.resumed
+
+	statErr := startErr
+	if statErr == nil {
+		statErr = endErr
+	}
+	if statErr != nil && !j.backendError[backendErrorStat] {
+		j.x.log.Printf("%sError reading the monitored files: %v", j.prefix(), statErr)
+	}
+	j.setBackendError(backendErrorStat, statErr != nil)
+
+	j.start, j.end = start, end
+	j.endFound = j.endFound || !end.IsZero()
+	j.observeResolution("start", start)
+	j.observeResolution("end", end)
+	j.setFileMtime(j.startFile, start)
+	j.setFileMtime(j.endFile, end)
+	j.setFileSize(j.startFile, startSize)
+	j.setFileSize(j.endFile, endSize)
+	if stats != nil {
+		j.setTreeStats(stats)
+	}
+	if isGlob(j.startFile) || isGlob(j.endFile) || j.c.EndRecursive {
+		j.promNewestMatch.Reset()
+		if isGlob(j.startFile) && startPath != "" {
+			j.promNewestMatch.WithLabelValues("start", startPath).Set(1)
+		}
+		if (isGlob(j.endFile) || j.c.EndRecursive) && endPath != "" {
+			j.promNewestMatch.WithLabelValues("end", endPath).Set(1)
+		}
+	}
+
+	if !start.IsZero() {
+		if end.IsZero() || start.After(end) {
+			if j.x.c.Debug {
+				j.x.log.Printf("%sAn update run started.", j.prefix())
+			}
+			if !start.Equal(j.oldStart) && (!j.createdAs("start").After(start) || resumed) {
+				j.promUpdateStarted.Inc()
+				notes = append(notes, Notification{Kind: RunStarted, Time: j.x.now(), Start: start, End: end})
+			}
+			j.promUpdateRunning.Set(1)
+		} else {
+			j.promUpdateRunning.Set(0)
+		}
+		if !start.Equal(j.oldStart) && !initial {
+			j.startSeen = j.x.now()
+		}
+		j.oldStart = start
+	}
+
+	if !end.IsZero() && !end.Equal(j.oldEnd) {
+		backwards := !j.oldEnd.IsZero() && end.Before(j.oldEnd)
+		if backwards {
+			j.anomaly(anomalyEndBackwards, "End file mtime went backwards from %s to %s.", j.oldEnd, end)
+		}
+		j.oldEnd = end
+		if backwards {
+			return
+		}
+		if start.After(end) {
+			if !initial {
+				j.anomaly(anomalyStartAfterEnd, "End file mtime %s is older than start file mtime %s.", end, start)
+			}
+			return
+		}
+		if j.createdAs("end").After(end) && !resumed {
+			if !initial {
+				j.anomaly(anomalyEndBeforeStartup, "End file mtime %s is older than exporter startup.", end)
+			}
+			return
+		}
+		if j.c.EndRequiresStart && !j.runOpen(start) {
+			// No run is open, e.g. a progress checkpoint of a run that
+			// has been counted already.
+			j.promEndHeartbeats.Inc()
+			return
+		}
+		if j.x.c.Debug {
+			j.x.log.Printf("%sAn update run ended.", j.prefix())
+		}
+		j.anomalies = 0
+		j.updated = true
+		j.promUpdateCount.Inc()
+		if !j.countedEnd.IsZero() {
+			j.runInterval = end.Sub(j.countedEnd)
+		}
+		j.countedEnd = end
+		j.promLastRunEnd.Set(float64(end.UnixNano()) / 1e9)
+		finished := Notification{Kind: RunFinished, Time: j.x.now(), Start: start, End: end}
+		if !start.IsZero() {
+			j.lastRunStart = start
+			j.promLastRunStart.Set(float64(start.UnixNano()) / 1e9)
+		}
+		if d, ok := j.runDuration(start, end); ok {
+			j.observeDuration(d)
+			finished.Duration = d
+		}
+		notes = append(notes, finished)
+	}
+}
+
+// countRows sets last_output_rows to the number of lines of the end file
+// at path if its mtime end is new, catching fresh but empty output.
+func (j *job) countRows(end time.Time, path string) {
+	if j.c.CountRowsMaxSize <= 0 || path == "" {
+		return
+	}
+	j.mu.RLock()
+	changed := !end.Equal(j.oldEnd)
+	j.mu.RUnlock()
+	if !changed {
+		return
+	}
+	rows, err := countRows(path, j.c.CountRowsMaxSize)
+	if err != nil {
+		j.x.log.Printf("%sError counting rows: %v", j.prefix(), err)
+		j.promLastOutputRows.Set(math.NaN())
+		return
+	}
+	j.promLastOutputRows.Set(float64(rows))
+}
+
+// setFileSize exports the size of a configured file, or removes its series
+// if size is negative. Must be called with j.mu held.
+func (j *job) setFileSize(file string, size int64) {
+	if file == "" {
+		return
+	}
+	if size < 0 {
+		j.promFileSize.DeleteLabelValues(file)
+		return
+	}
+	j.promFileSize.WithLabelValues(file).Set(float64(size))
+}
+
+// newConfigErrorVec returns the config_error_info metric of a job.
+func newConfigErrorVec(ns, sub string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "config_error_info",
+		Help:      "Present with value 1 while the job is misconfigured, by reason.",
+	}, []string{"reason"})
+}
+
+// setConfigError sets or clears the config error reason.
+func (j *job) setConfigError(reason string, on bool) {
+	if on {
+		j.promConfigError.WithLabelValues(reason).Set(1)
+	} else {
+		j.promConfigError.DeleteLabelValues(reason)
+	}
+}
+
+// setBackendError sets or clears the backend error reason. Must be called
+// with j.mu held.
+func (j *job) setBackendError(reason string, on bool) {
+	if on && !j.backendError[reason] {
+		j.x.reporter.report(j, "Backend error: "+reason)
+	}
+	j.backendError[reason] = on
+	if on {
+		j.promBackendError.WithLabelValues(reason).Set(1)
+	} else {
+		j.promBackendError.DeleteLabelValues(reason)
+	}
+	success := 1.0
+	for _, on := range j.backendError {
+		if on {
+			success = 0
+		}
+	}
+	j.promCollectionSuccess.Set(success)
+}
+
+// setFileMtime exports the mtime of a configured file and whether it
+// exists. The mtime series of missing files are removed. Must be called with
+// j.mu held.
+func (j *job) setFileMtime(file string, mtime time.Time) {
+	if file == "" {
+		return
+	}
+	if mtime.IsZero() {
+		j.promFileMtime.DeleteLabelValues(file)
+		j.promFileExists.WithLabelValues(file).Set(0)
+		return
+	}
+	j.promFileExists.WithLabelValues(file).Set(1)
+	j.promFileMtime.WithLabelValues(file).Set(float64(mtime.UnixNano()) / 1e9)
+}
+
+// runDuration returns the duration of the update run that ended with end,
+// by the configured duration source. Must be called with j.mu held.
+func (j *job) runDuration(start, end time.Time) (time.Duration, bool) {
+	if start.IsZero() {
+		return 0, false
+	}
+	if j.c.DurationSource == DurationEvents {
+		if j.startSeen.IsZero() {
+			// The run started before the exporter did.
+			return 0, false
+		}
+		return j.x.since(j.startSeen), true
+	}
+	return end.Sub(start), true
+}
+
+// observeDuration records the duration of an update run unless it is out of
+// the configured plausible bounds, give or take the mtime resolution. Must be
+// called with j.mu held.
+func (j *job) observeDuration(d time.Duration) {
+	j.lastDuration, j.durationSet = d, true
+	j.promLastDuration.Set(d.Seconds())
+	tol := j.durationTolerance()
+	if (j.c.MinDuration > 0 && d+tol < j.c.MinDuration) || (j.c.MaxDuration > 0 && d-tol > j.c.MaxDuration) {
+		j.x.log.Printf("%sImplausible update run duration %s.", j.prefix(), d)
+		j.promImplausibleDuration.Inc()
+		return
+	}
+	j.promUpdateDuration.Observe(d.Seconds())
+}
+
+// anomaly counts and logs an end file change that does not look like a
+// regular update run. Must be called with j.mu held.
+func (j *job) anomaly(kind, format string, args ...interface{}) {
+	j.promUpdateAnomalies.WithLabelValues(kind).Inc()
+	j.anomalies++
+	j.x.log.Printf(j.prefix()+format, args...)
+}
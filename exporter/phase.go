@@ -0,0 +1,122 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Phase is an intermediate marker file of an update run, like
+// extract.done, touched when a phase of the run has completed.
+type Phase struct {
+	Name string `yaml:"name"`
+	File string `yaml:"file"`
+}
+
+// Phases are the phases of a run in order. It implements flag.Value and is
+// set from "name=file".
+type Phases []Phase
+
+func (p *Phases) String() string {
+	if p == nil {
+		return ""
+	}
+	pairs := make([]string, len(*p))
+	for i, ph := range *p {
+		pairs[i] = ph.Name + "=" + ph.File
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (p *Phases) Set(s string) error {
+	name, file, ok := strings.Cut(s, "=")
+	if !ok || name == "" || file == "" {
+		return fmt.Errorf("phase %q is not of the form name=file", s)
+	}
+	*p = append(*p, Phase{Name: name, File: file})
+	return nil
+}
+
+// resolve validates p and returns the resolved files of the phases.
+func (p Phases) resolve() ([]string, error) {
+	files := make([]string, len(p))
+	names := make(map[string]bool)
+	for i, ph := range p {
+		if ph.Name == "" || ph.File == "" {
+			return nil, fmt.Errorf("phase %d needs a name and a file", i+1)
+		}
+		if names[ph.Name] {
+			return nil, fmt.Errorf("duplicate phase %q", ph.Name)
+		}
+		names[ph.Name] = true
+		var err error
+		if files[i], err = resolvePath(ph.File); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// newPhaseMetrics creates the metrics of the phases of a run.
+func newPhaseMetrics(ns, sub string) (completed, duration *prometheus.GaugeVec) {
+	completed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "phase_completed_timestamp_seconds",
+		Help:      "Modification time of the marker file of a phase since unix epoch in seconds, by phase.",
+	}, []string{"phase"})
+	duration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "phase_duration_seconds",
+		Help:      "Duration of a phase of the current or last update run in seconds, by phase.",
+	}, []string{"phase"})
+	return completed, duration
+}
+
+// collectPhases measures the phase markers. The duration of a phase is the
+// time from the marker of the previous phase, or the start file for the
+// first phase, to its own marker. It is only exported if both belong to the
+// current or last run, i.e. are not older than the start file.
+func (j *job) collectPhases() {
+	if len(j.phaseFiles) == 0 {
+		return
+	}
+	j.mu.RLock()
+	runStart := j.start
+	j.mu.RUnlock()
+
+	prev := runStart
+	for i, ph := range j.c.Phases {
+		mtime, _, _ := measure(j.phaseFiles[i], nil, nil)
+		if mtime.IsZero() {
+			j.promPhaseCompleted.DeleteLabelValues(ph.Name)
+			j.promPhaseDuration.DeleteLabelValues(ph.Name)
+			prev = time.Time{}
+			continue
+		}
+		j.promPhaseCompleted.WithLabelValues(ph.Name).Set(float64(mtime.UnixNano()) / 1e9)
+		if prev.IsZero() || mtime.Before(prev) || mtime.Before(runStart) {
+			j.promPhaseDuration.DeleteLabelValues(ph.Name)
+		} else {
+			j.promPhaseDuration.WithLabelValues(ph.Name).Set(mtime.Sub(prev).Seconds())
+		}
+		prev = mtime
+	}
+}
@@ -0,0 +1,271 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watcher reports the events of the entries of the directories added to
+// it. It is an fsnotify.Watcher, or with Config.PollInterval a pollWatcher.
+type watcher interface {
+	Add(dir string) error
+	Remove(dir string) error
+	Close() error
+	eventChan() <-chan fsnotify.Event
+	errorChan() <-chan error
+}
+
+// notifyWatcher is a watcher by fs notifications. The zero value blocks
+// forever.
+type notifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+func (w notifyWatcher) eventChan() <-chan fsnotify.Event { return w.Events }
+func (w notifyWatcher) errorChan() <-chan error          { return w.Errors }
+
+// newWatcher returns a watcher of the configured kind.
+func (x *Exporter) newWatcher() (watcher, error) {
+	if x.poller != nil {
+		return x.poller.watcher(), nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return notifyWatcher{w}, nil
+}
+
+// poller polls the directories of all pollWatchers every interval. It is a
+// single goroutine for all jobs, where fs notifications take one per
+// watcher.
+type poller struct {
+	interval time.Duration
+	done     <-chan struct{}
+	loop     chan struct{} // closed once run returned
+
+	mu       sync.Mutex
+	watchers map[*pollWatcher]bool
+}
+
+func newPoller(interval time.Duration, done <-chan struct{}) *poller {
+	p := &poller{
+		interval: interval,
+		done:     done,
+		loop:     make(chan struct{}),
+		watchers: make(map[*pollWatcher]bool),
+	}
+	go p.run()
+	return p
+}
+
+// run polls until done is closed.
+func (p *poller) run() {
+	defer close(p.loop)
+	tick := time.NewTicker(p.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-p.done:
+			return
+		}
+		p.mu.Lock()
+		watchers := make([]*pollWatcher, 0, len(p.watchers))
+		for w := range p.watchers {
+			watchers = append(watchers, w)
+		}
+		p.mu.Unlock()
+		for _, w := range watchers {
+			w.poll(p.done)
+		}
+	}
+}
+
+// watcher returns a new pollWatcher polled by p.
+func (p *poller) watcher() *pollWatcher {
+	w := &pollWatcher{
+		p:      p,
+		dirs:   make(map[string]map[string]pollEntry),
+		events: make(chan fsnotify.Event),
+		errs:   make(chan error),
+		closed: make(chan struct{}),
+	}
+	p.mu.Lock()
+	p.watchers[w] = true
+	p.mu.Unlock()
+	return w
+}
+
+// pollWatcher is a watcher that compares listings of its directories. Like
+// inotify it reports new entries as Create, files whose mtime or size
+// changed as Write, vanished entries as Remove, and a vanished directory as
+// Remove of the directory itself. Renames are a Remove and a Create, and
+// changes between two polls that cancel out go unnoticed.
+type pollWatcher struct {
+	p      *poller
+	events chan fsnotify.Event
+	errs   chan error
+	closed chan struct{}
+	once   sync.Once
+
+	mu   sync.Mutex
+	dirs map[string]map[string]pollEntry // listings by directory
+}
+
+// pollEntry is what a listing knows about an entry.
+type pollEntry struct {
+	mtime time.Time
+	size  int64
+	dir   bool
+}
+
+func (w *pollWatcher) Add(dir string) error {
+	w.mu.Lock()
+	_, ok := w.dirs[dir]
+	w.mu.Unlock()
+	if ok {
+		return nil
+	}
+	entries, err := listDir(dir)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[dir] = entries
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *pollWatcher) Remove(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.dirs, dir)
+	return nil
+}
+
+func (w *pollWatcher) Close() error {
+	w.once.Do(func() {
+		w.p.mu.Lock()
+		delete(w.p.watchers, w)
+		w.p.mu.Unlock()
+		close(w.closed)
+	})
+	return nil
+}
+
+func (w *pollWatcher) eventChan() <-chan fsnotify.Event { return w.events }
+func (w *pollWatcher) errorChan() <-chan error          { return w.errs }
+
+// poll lists the directories of w and sends the events of what changed
+// since the last poll. It returns early if w is closed or done is.
+func (w *pollWatcher) poll(done <-chan struct{}) {
+	w.mu.Lock()
+	dirs := make([]string, 0, len(w.dirs))
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	w.mu.Unlock()
+	sort.Strings(dirs)
+
+	var events []fsnotify.Event
+	var errs []error
+	for _, dir := range dirs {
+		entries, err := listDir(dir)
+		w.mu.Lock()
+		old, ok := w.dirs[dir]
+		switch {
+		case !ok:
+			// Removed meanwhile.
+		case errors.Is(err, fs.ErrNotExist):
+			delete(w.dirs, dir)
+			events = append(events, fsnotify.Event{Name: dir, Op: fsnotify.Remove})
+		case err != nil:
+			errs = append(errs, err)
+		default:
+			w.dirs[dir] = entries
+			events = append(events, diffListings(dir, old, entries)...)
+		}
+		w.mu.Unlock()
+	}
+
+	for _, e := range events {
+		select {
+		case w.events <- e:
+		case <-w.closed:
+			return
+		case <-done:
+			return
+		}
+	}
+	for _, err := range errs {
+		select {
+		case w.errs <- err:
+		case <-w.closed:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// diffListings returns the events that turn the listing old of dir into
+// cur, in the order of the entries' names.
+func diffListings(dir string, old, cur map[string]pollEntry) []fsnotify.Event {
+	var events []fsnotify.Event
+	for name, e := range cur {
+		prev, ok := old[name]
+		switch {
+		case !ok || prev.dir != e.dir:
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Create})
+		case !e.dir && (!e.mtime.Equal(prev.mtime) || e.size != prev.size):
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Write})
+		}
+	}
+	for name := range old {
+		if _, ok := cur[name]; !ok {
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
+// listDir returns the entries of dir by name. Entries that vanish while
+// listing are left out.
+func listDir(dir string) (map[string]pollEntry, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]pollEntry, len(des))
+	for _, de := range des {
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		entries[de.Name()] = pollEntry{mtime: fi.ModTime(), size: fi.Size(), dir: fi.IsDir()}
+	}
+	return entries, nil
+}
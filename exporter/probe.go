@@ -0,0 +1,182 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeModule is a ProbeModule with its prefixes resolved.
+type probeModule struct {
+	ProbeModule
+	roots []string
+}
+
+// loadModules reads the probe modules of the config file. Modules without
+// prefixes get the stat roots.
+func (x *Exporter) loadModules(file string) (map[string]probeModule, error) {
+	modules, err := LoadModules(file)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]probeModule, len(modules))
+	for name, m := range modules {
+		roots := x.statRoots
+		if len(m.Prefixes) > 0 {
+			roots, err = resolveRoots(m.Prefixes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: module %q: %w", file, name, err)
+			}
+		}
+		resolved[name] = probeModule{ProbeModule: m, roots: roots}
+	}
+	return resolved, nil
+}
+
+// module returns the probe module called name.
+func (x *Exporter) module(name string) (probeModule, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	m, ok := x.modules[name]
+	return m, ok
+}
+
+// probeHandler stats the file given by the query parameter target at scrape
+// time and serves metrics about it, like the blackbox exporter does for
+// network targets. The query parameter module selects the rules of a probe
+// module, else the paths are restricted to the stat roots. With the query
+// parameter max_age, or the module's, probe_success also requires the file
+// to be younger than that. The parameter path is an alias of target.
+func (x *Exporter) probeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	m := probeModule{roots: x.statRoots}
+	if name := q.Get("module"); name != "" {
+		var ok bool
+		if m, ok = x.module(name); !ok {
+			http.Error(w, fmt.Sprintf("unknown module %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+	target := q.Get("target")
+	if target == "" {
+		target = q.Get("path")
+	}
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	maxAge := m.MaxAge
+	if s := q.Get("max_age"); s != "" {
+		var err error
+		maxAge, err = time.ParseDuration(s)
+		if err != nil || maxAge <= 0 {
+			http.Error(w, "max_age parameter must be a positive duration like 1h", http.StatusBadRequest)
+			return
+		}
+	}
+
+	began := time.Now()
+	res, matches := x.probe(target, m)
+	switch res.Error {
+	case statErrNotAbsolute, statErrOutsideRoots, statErrBadPattern:
+		http.Error(w, res.Error, http.StatusBadRequest)
+		return
+	}
+	if res.Error != "" {
+		x.log.Printf("Error probing %s: %s", target, res.Error)
+	}
+	gauge := func(name, help string, v float64) prometheus.Gauge {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help})
+		g.Set(v)
+		return g
+	}
+	reg := prometheus.NewRegistry()
+	success := res.Exists && res.Error == "" && (maxAge == 0 || res.AgeSeconds < maxAge.Seconds())
+	reg.MustRegister(
+		gauge("probe_success", "1 if the file exists and is younger than max_age, if given.", boolToFloat(success)),
+		gauge("probe_file_exists", "1 if the file exists.", boolToFloat(res.Exists)),
+		gauge("probe_duration_seconds", "How long the probe took in seconds.", time.Since(began).Seconds()),
+	)
+	if maxAge > 0 {
+		reg.MustRegister(gauge("probe_file_max_age_seconds", "The max_age the file was probed with in seconds.", maxAge.Seconds()))
+	}
+	if m.Glob == GlobNewest || m.Glob == GlobOldest {
+		reg.MustRegister(gauge("probe_file_matches", "Number of files matching the target pattern.", float64(matches)))
+	}
+	if res.Exists {
+		reg.MustRegister(
+			gauge("probe_file_mtime_timestamp_seconds", "Modification time of the file.", float64(res.Mtime.UnixNano())/1e9),
+			gauge("probe_file_age_seconds", "Age of the file in seconds.", res.AgeSeconds),
+			gauge("probe_file_size_bytes", "Size of the file in bytes.", float64(res.Size)),
+		)
+		if res.ctime != nil {
+			reg.MustRegister(gauge("probe_file_ctime_timestamp_seconds", "Inode change time of the file.", float64(res.ctime.UnixNano())/1e9))
+		}
+	}
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probe stats target by the rules of m. If m globs, target is a pattern and
+// the result is the newest or oldest of the matches, which are counted.
+// Matches that resolve to outside the roots are left out.
+func (x *Exporter) probe(target string, m probeModule) (statResult, int) {
+	if m.Glob != GlobNewest && m.Glob != GlobOldest {
+		return x.statWithin(target, m.roots, m.Timestamp), 0
+	}
+	res := statResult{Path: target}
+	if !filepath.IsAbs(target) {
+		res.Error = statErrNotAbsolute
+		return res, 0
+	}
+	if !withinRoots(m.roots, filepath.Clean(target)) {
+		res.Error = statErrOutsideRoots
+		return res, 0
+	}
+	names, err := filepath.Glob(target)
+	if err != nil {
+		res.Error = statErrBadPattern
+		return res, 0
+	}
+	matches := 0
+	for _, name := range names {
+		match := x.statWithin(name, m.roots, m.Timestamp)
+		if match.Error == statErrOutsideRoots || (match.Error == "" && !match.Exists) {
+			continue
+		}
+		if match.Error != "" {
+			return match, matches
+		}
+		matches++
+		newer := match.AgeSeconds < res.AgeSeconds
+		if !res.Exists || newer == (m.Glob == GlobNewest) {
+			res = match
+		}
+	}
+	return res, matches
+}
+
+// boolToFloat returns 1 for true and 0 for false.
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
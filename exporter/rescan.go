@@ -0,0 +1,56 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Rescans re-measure the files every RescanInterval in case fs events got
+// lost. To avoid IO spikes on filers hosting many files, the rescans of all
+// jobs are spread over the interval and each pauses after every chunk of
+// stat calls.
+const (
+	rescanJitter = 0.2
+	rescanChunk  = 1000
+	rescanPause  = 100 * time.Millisecond
+)
+
+// pacer paces the stat calls of a rescan. A nil pacer doesn't pause.
+type pacer struct {
+	n int
+}
+
+// step is called before each stat call.
+func (p *pacer) step() {
+	if p == nil {
+		return
+	}
+	p.n++
+	if p.n%rescanChunk == 0 {
+		time.Sleep(rescanPause)
+	}
+}
+
+// firstRescan returns when the first rescan is due, at a random point of
+// the interval so that the rescans of many jobs don't coincide. It never
+// returns if rescans are disabled.
+func (j *job) firstRescan() <-chan time.Time {
+	if j.c.RescanInterval <= 0 {
+		return nil
+	}
+	return time.After(time.Duration(rand.Int63n(int64(j.c.RescanInterval))))
+}
@@ -0,0 +1,96 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"time"
+)
+
+// mtimeResolutions are the mtime resolutions of common file systems, from
+// coarse to fine, each a multiple of the next: FAT, ext3 and NFS servers
+// that truncate to seconds, HFS+ style milliseconds, microseconds, NTFS and
+// full nanoseconds.
+var mtimeResolutions = []time.Duration{
+	2 * time.Second,
+	time.Second,
+	time.Millisecond,
+	time.Microsecond,
+	100 * time.Nanosecond,
+	time.Nanosecond,
+}
+
+// mtimeGranularity returns the coarsest resolution that mtime is a multiple
+// of.
+func mtimeGranularity(mtime time.Time) time.Duration {
+	ns := mtime.UnixNano()
+	for _, res := range mtimeResolutions {
+		if ns%int64(res) == 0 {
+			return res
+		}
+	}
+	return time.Nanosecond
+}
+
+// observeResolution narrows down the mtime resolution of the file system of
+// the role's file, "start" or "end", from its mtime. The resolution is the
+// coarsest one that all mtimes seen so far are a multiple of. Must be called
+// with j.mu held.
+func (j *job) observeResolution(role string, mtime time.Time) {
+	if mtime.IsZero() {
+		return
+	}
+	res := mtimeGranularity(mtime)
+	if cur, ok := j.mtimeRes[role]; ok && cur <= res {
+		return
+	}
+	j.mtimeRes[role] = res
+	j.promMtimeResolution.WithLabelValues(role).Set(res.Seconds())
+}
+
+// createdAs returns the startup time of the job truncated to the mtime
+// resolution of the role's file, so that a file touched right after startup
+// doesn't look older than the exporter. Must be called with j.mu held.
+func (j *job) createdAs(role string) time.Time {
+	return j.created.Truncate(j.mtimeRes[role])
+}
+
+// runOpen reports whether the start file changed since the last counted run
+// ended. Truncated mtimes of a start right after the last end may be equal
+// to it; then the start counts as new unless it is the start of the last
+// counted run. Must be called with j.mu held.
+func (j *job) runOpen(start time.Time) bool {
+	if start.After(j.countedEnd) {
+		return true
+	}
+	return start.Equal(j.countedEnd) && !start.Equal(j.lastRunStart)
+}
+
+// runElapsed returns how long the update run in progress has been running,
+// false if none is. Must be called with j.mu held.
+func (j *job) runElapsed() (time.Duration, bool) {
+	if j.start.IsZero() || (!j.end.IsZero() && !j.start.After(j.end)) {
+		return 0, false
+	}
+	return max(j.x.since(j.start), 0), true
+}
+
+// durationTolerance returns by how much a run duration computed from
+// truncated mtimes may be off. Must be called with j.mu held.
+func (j *job) durationTolerance() time.Duration {
+	if j.c.DurationSource == DurationEvents {
+		return 0
+	}
+	return max(j.mtimeRes["start"], j.mtimeRes["end"])
+}
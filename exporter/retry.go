@@ -0,0 +1,65 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes an exponential backoff. The zero value starts at one
+// second and doubles without limit or jitter, retrying forever.
+type RetryPolicy struct {
+	// MaxAttempts is the number of retries after which to give up; zero
+	// means no limit.
+	MaxAttempts int
+	// Backoff is the delay before the first retry.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries; zero means no cap.
+	MaxBackoff time.Duration
+	// Jitter randomizes each delay by up to this fraction, e.g. 0.2 for
+	// ±20%.
+	Jitter float64
+}
+
+// delay returns the delay before retry number attempt, starting at 0.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	if d <= 0 {
+		d = time.Second
+	}
+	for i := 0; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			d = p.MaxBackoff
+			break
+		}
+	}
+	return jitter(d, p.Jitter)
+}
+
+// exhausted reports whether retry number attempt, starting at 0, is over
+// the limit.
+func (p RetryPolicy) exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
+
+// jitter randomizes d by up to fraction, e.g. 0.2 for ±20%.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * fraction * float64(d))
+	}
+	return d
+}
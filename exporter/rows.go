@@ -0,0 +1,61 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// countRows counts the lines of file, the last one also if it lacks a
+// trailing newline. Files larger than maxSize bytes are not read.
+func countRows(file string, maxSize int64) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() > maxSize {
+		return 0, fmt.Errorf("%s has %d bytes, more than the limit of %d", file, fi.Size(), maxSize)
+	}
+
+	var rows int64
+	last := byte('\n')
+	buf := make([]byte, 32*1024)
+	r := io.LimitReader(f, maxSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			rows += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if last != '\n' {
+		rows++
+	}
+	return rows, nil
+}
@@ -0,0 +1,161 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selftestTimeout is how long a self-test waits for its fs event.
+const selftestTimeout = 5 * time.Second
+
+// selftest checks end to end that fs events arrive on this host by writing
+// a file into a scratch directory that is watched just like the jobs'
+// directories.
+type selftest struct {
+	dir             string
+	watcher         *fsnotify.Watcher
+	promSuccess     prometheus.Gauge
+	promLatency     prometheus.Gauge
+	promLastAttempt prometheus.Gauge
+
+	run     sync.Mutex // one self-test at a time
+	mu      sync.Mutex
+	waiting map[string]chan struct{} // by file name
+}
+
+func (x *Exporter) newSelftest(dir string) (*selftest, error) {
+	ns, sub := x.c.Namespace, x.c.Subsystem
+	t := &selftest{
+		dir:     dir,
+		waiting: make(map[string]chan struct{}),
+		promSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "selftest_success",
+			Help:      "If the last self-test saw its fs event in time: 0 no; 1 yes.",
+		}),
+		promLatency: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "selftest_latency_seconds",
+			Help:      "Time from writing the self-test file until its fs event arrived.",
+		}),
+		promLastAttempt: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "selftest_last_attempt_timestamp_seconds",
+			Help:      "Time of the last self-test since unix epoch in seconds.",
+		}),
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, &WatchError{Path: dir, Err: err}
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return nil, &WatchError{Path: dir, Err: err}
+	}
+	t.watcher = w
+	x.register(t.promSuccess, t.promLatency, t.promLastAttempt)
+	go func() {
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				t.mu.Lock()
+				if ch, ok := t.waiting[filepath.Base(e.Name)]; ok {
+					close(ch)
+					delete(t.waiting, filepath.Base(e.Name))
+				}
+				t.mu.Unlock()
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				x.log.Printf("Error waiting for fs event in self-test directory: %v", err)
+			}
+		}
+	}()
+	return t, nil
+}
+
+// close stops watching the self-test directory.
+func (t *selftest) close() {
+	t.watcher.Close()
+}
+
+// do writes and removes a file and waits for its event.
+func (t *selftest) do() (time.Duration, error) {
+	t.run.Lock()
+	defer t.run.Unlock()
+
+	name := fmt.Sprintf(".fileage-selftest-%d", time.Now().UnixNano())
+	ch := make(chan struct{})
+	t.mu.Lock()
+	t.waiting[name] = ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.waiting, name)
+		t.mu.Unlock()
+	}()
+
+	file := filepath.Join(t.dir, name)
+	begin := time.Now()
+	t.promLastAttempt.Set(float64(begin.UnixNano()) / 1e9)
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.promSuccess.Set(0)
+		return 0, err
+	}
+	defer os.Remove(file)
+
+	select {
+	case <-ch:
+		latency := time.Since(begin)
+		t.promSuccess.Set(1)
+		t.promLatency.Set(latency.Seconds())
+		return latency, nil
+	case <-time.After(selftestTimeout):
+		t.promSuccess.Set(0)
+		return 0, fmt.Errorf("no fs event for %s within %s", file, selftestTimeout)
+	}
+}
+
+func (x *Exporter) selftestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	latency, err := x.selftest.do()
+	if err != nil {
+		x.log.Printf("Self-test failed: %v", err)
+		http.Error(w, "selftest: failed: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = fmt.Fprintf(w, "selftest: ok, fs event after %s\r\n", latency)
+}
@@ -15,25 +15,119 @@
 package exporter
 
 import (
+	"net"
 	"net/http"
+	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func NewDefaultServer(x *Exporter) *http.Server {
-	// TODO this is not nicely done
-	x.WrapPromHandler(promhttp.Handler())
+// Server serves the exporter's endpoints on its Listener.
+type Server struct {
+	*http.Server
+	// Listener is served by Serve. If nil, Serve listens at Config.Listen.
+	Listener net.Listener
+}
+
+// Serve serves on s.Listener until the server is shut down, see
+// http.Server.Serve.
+func (s *Server) Serve() error {
+	if s.Listener == nil {
+		return s.Server.ListenAndServe()
+	}
+	return s.Server.Serve(s.Listener)
+}
 
+// NewDefaultServer returns a server for the exporter's endpoints at the
+// paths of the Config. It serves l, e.g. the socket of systemd socket
+// activation returned by Listen, or if l is nil listens at Config.Listen.
+func NewDefaultServer(x *Exporter, l net.Listener) *Server {
 	mux := http.NewServeMux()
-	mux.HandleFunc(x.c.PromEndpoint, x.PromHandler)
-	mux.HandleFunc(x.c.HealthEndpoint, x.healthHandler)
-	mux.HandleFunc(x.c.LivenessEndpoint, x.livenessHandler)
+	x.Mount(mux, "")
 
 	s := &http.Server{
 		Addr:        x.c.Listen,
 		ReadTimeout: 3e9,
 		Handler:     mux,
 	}
+	if x.c.GRPCHealth {
+		// A read timeout would also cut off long-lived Watch streams, so
+		// only limit reading the request header.
+		s.ReadTimeout, s.ReadHeaderTimeout = 0, 3e9
+		s.Handler = x.grpcHealthHandler(mux)
+	}
 	s.SetKeepAlivesEnabled(false)
-	return s
+	return &Server{Server: s, Listener: l}
+}
+
+// Routes returns a handler for the exporter's endpoints at the paths of the
+// Config, for programs that run their own HTTP server. Unlike
+// NewDefaultServer it doesn't serve gRPC health.
+func (x *Exporter) Routes() http.Handler {
+	mux := http.NewServeMux()
+	x.Mount(mux, "")
+	return mux
+}
+
+// Mount registers the exporter's endpoints on mux below prefix, e.g. the
+// metrics at /fileage/metrics for prefix "/fileage". Endpoints whose path in
+// the Config is empty are left out.
+func (x *Exporter) Mount(mux *http.ServeMux, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	handle := func(path string, h http.HandlerFunc) {
+		if path == "" {
+			return
+		}
+		if prefix == "" {
+			mux.Handle(path, h)
+			return
+		}
+		mux.Handle(prefix+path, http.StripPrefix(prefix, h))
+	}
+
+	promHandler := promhttp.Handler()
+	registerer, gatherer := prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	if g, ok := x.registerer().(prometheus.Gatherer); ok && x.c.Registerer != nil {
+		registerer, gatherer = x.registerer(), g
+		promHandler = promhttp.InstrumentMetricHandler(registerer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	}
+	if len(x.echoParams) > 0 {
+		promHandler = promhttp.InstrumentMetricHandler(registerer, x.echoHandler(gatherer))
+	}
+
+	if x.c.MetricsRequireReady {
+		promHandler = x.requireMeasured(promHandler)
+	}
+	handle(x.c.PromEndpoint, x.auth.wrap("prom", promHandler.ServeHTTP))
+	handle(x.c.HealthEndpoint, x.auth.wrap("health", x.healthHandler))
+	if x.c.ConfigFile != "" && jobHealthPrefix(x.c.HealthEndpoint) != x.c.HealthEndpoint {
+		handle(jobHealthPrefix(x.c.HealthEndpoint), x.auth.wrap("health", x.jobHealthHandler))
+	}
+	handle(x.c.LivenessEndpoint, x.auth.wrap("liveness", x.livenessHandler))
+	handle(x.c.ReadinessEndpoint, x.auth.wrap("readiness", x.readinessHandler))
+	handle(x.c.StartupEndpoint, x.auth.wrap("startup", x.startupHandler))
+	if x.selftest != nil {
+		handle(x.c.SelftestEndpoint, x.auth.wrap("selftest", x.selftestHandler))
+	}
+	if len(x.statRoots) > 0 {
+		handle(x.c.StatEndpoint, x.auth.wrap("stat", x.statHandler))
+	}
+	// Modules may come with a reload, so the probe endpoint is there with
+	// any config file.
+	if len(x.statRoots) > 0 || x.c.ConfigFile != "" {
+		handle(x.c.ProbeEndpoint, x.auth.wrap("probe", x.probeHandler))
+	}
+	if x.auth != nil {
+		// Acknowledgements and snoozes are recorded by user, so they always
+		// need auth.
+		handle(x.c.AckEndpoint, x.auth.require(x.ackHandler))
+		handle(x.c.SnoozeEndpoint, x.auth.require(x.snoozeHandler))
+	}
+	if x.c.ConfigFile != "" || x.c.Job.Tenant != "" {
+		handle(x.c.TenantEndpoint, x.tenantHandler)
+	}
+	if x.c.ConfigFile != "" {
+		handle(x.c.ReloadEndpoint, x.auth.wrap("reload", x.reloadHandler))
+	}
 }
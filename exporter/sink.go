@@ -0,0 +1,135 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import "time"
+
+// Sink receives notifications about the monitored jobs, see Config.Sinks.
+// Notify is called from the jobs' watch loops and must not block; sinks
+// that talk to the network should queue.
+type Sink interface {
+	Notify(Notification)
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(Notification)
+
+func (f SinkFunc) Notify(n Notification) { f(n) }
+
+// NotificationKind tells what a Notification is about.
+type NotificationKind string
+
+const (
+	// RunStarted is sent when the start file of a new update run appears.
+	RunStarted NotificationKind = "run_started"
+	// RunFinished is sent for every regular update run, i.e. one that is
+	// counted by update_count_total.
+	RunFinished NotificationKind = "run_finished"
+	// StateChanged is sent when the update state changes, e.g. from fresh
+	// to stale. States that only change with time are noticed within
+	// heartbeatInterval.
+	StateChanged NotificationKind = "state_changed"
+	// RunProgress is sent each Job.RunCheckpoint that an update run goes
+	// on, with Duration being how long it has been running so far.
+	RunProgress NotificationKind = "run_progress"
+)
+
+// Notification is a change of a job.
+type Notification struct {
+	Kind NotificationKind
+	// Job is the name of the job, empty for the job configured by flags.
+	Job string
+	// Time is when the exporter noticed the change.
+	Time time.Time
+	// Start and End are the mtimes of the start and end file, zero if
+	// unknown. Duration is the duration of a finished run, 0 if unknown, or
+	// the elapsed time of RunProgress.
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+	// State and PreviousState are the new and old state of StateChanged,
+	// one of the State constants.
+	State         string
+	PreviousState string
+}
+
+// notify sends n to all sinks unless the job is snoozed. It must not be
+// called with j.mu held.
+func (j *job) notify(ns ...Notification) {
+	if _, snoozed := j.snoozed(); snoozed {
+		return
+	}
+	for _, n := range ns {
+		n.Job = j.c.Name
+		for _, s := range j.x.c.Sinks {
+			s.Notify(n)
+		}
+	}
+}
+
+// checkState sends StateChanged if the state changed since the last call,
+// and notes transitions of health and liveness.
+func (j *job) checkState() {
+	j.transition(checkHealth, j.healthStatus())
+	j.transition(checkLiveness, j.livenessStatus())
+	state := j.state()
+	j.mu.Lock()
+	prev := j.lastState
+	j.lastState = state
+	start, end := j.start, j.end
+	j.mu.Unlock()
+	if state == prev {
+		return
+	}
+	j.notify(Notification{
+		Kind:          StateChanged,
+		Time:          j.x.now(),
+		Start:         start,
+		End:           end,
+		State:         state,
+		PreviousState: prev,
+	})
+}
+
+// checkProgress logs and sends RunProgress if the update run in progress
+// has passed another Job.RunCheckpoint since the last call.
+func (j *job) checkProgress() {
+	if j.c.RunCheckpoint <= 0 {
+		return
+	}
+	j.mu.Lock()
+	elapsed, running := j.runElapsed()
+	start, end := j.start, j.end
+	if !start.Equal(j.progressRun) {
+		j.progressRun, j.checkpoints = start, 0
+	}
+	n := int(elapsed / j.c.RunCheckpoint)
+	due := running && n > j.checkpoints
+	if due {
+		j.checkpoints = n
+	}
+	j.mu.Unlock()
+	if !due {
+		return
+	}
+	j.x.log.Printf("%sUpdate run still running since %s.", j.prefix(), start.Format(time.RFC3339))
+	j.notify(Notification{
+		Kind:     RunProgress,
+		Time:     j.x.now(),
+		Start:    start,
+		End:      end,
+		Duration: elapsed,
+	})
+}
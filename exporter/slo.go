@@ -0,0 +1,92 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// slo accounts the time a job was observed and the part of it the job was
+// stale, i.e. older than the health timeout after welpenschutz, for
+// burn-rate alerts on a freshness SLO.
+type slo struct {
+	mu           sync.Mutex
+	accounted    time.Time // up to when time has been accounted
+	promObserved prometheus.Counter
+	promStale    prometheus.Counter
+}
+
+func newSLO(ns, sub string, since time.Time) *slo {
+	return &slo{
+		accounted: since,
+		promObserved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "observed_seconds_total",
+			Help:      "Counter of seconds the job has been observed.",
+		}),
+		promStale: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "stale_seconds_total",
+			Help:      "Counter of observed seconds the job was stale, i.e. older than the health timeout after welpenschutz.",
+		}),
+	}
+}
+
+// accountSLO accounts the time since the last call. It must be called
+// before the end file or acknowledgement change, so that they were constant
+// during the accounted time and its stale part is exact.
+func (j *job) accountSLO() {
+	remaining := j.welpenschutzRemaining()
+	j.mu.RLock()
+	fresh := j.end
+	if j.acked.After(fresh) {
+		fresh = j.acked
+	}
+	j.mu.RUnlock()
+
+	s := j.slo
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := j.x.now()
+	if !t.After(s.accounted) {
+		// The clock went backwards; nothing to account.
+		s.accounted = t
+		return
+	}
+	s.promObserved.Add(t.Sub(s.accounted).Seconds())
+	if remaining != welpenschutzOpen {
+		// Stale from the later of the end of welpenschutz and the health
+		// timeout after the last update.
+		var staleFrom time.Time
+		if remaining > 0 {
+			staleFrom = t.Add(remaining)
+		}
+		if timeout := fresh.Add(j.c.HealthTimeout); !fresh.IsZero() && timeout.After(staleFrom) {
+			staleFrom = timeout
+		}
+		if s.accounted.After(staleFrom) {
+			staleFrom = s.accounted
+		}
+		if t.After(staleFrom) {
+			s.promStale.Add(t.Sub(staleFrom).Seconds())
+		}
+	}
+	s.accounted = t
+}
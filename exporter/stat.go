@@ -0,0 +1,167 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Limits of a single stat API request.
+const (
+	statMaxPaths = 1000
+	statMaxBody  = 1 << 20
+)
+
+// Errors of paths that may not be looked at.
+const (
+	statErrNotAbsolute  = "path must be absolute"
+	statErrOutsideRoots = "path is outside the allowed roots"
+	statErrNoCtime      = "ctime is not available on this platform"
+	statErrBadPattern   = "invalid glob pattern"
+)
+
+// statResult is the outcome for one path of a stat API request.
+type statResult struct {
+	Path       string     `json:"path"`
+	Exists     bool       `json:"exists"`
+	Mtime      *time.Time `json:"mtime,omitempty"`
+	Size       int64      `json:"size"`
+	AgeSeconds float64    `json:"age_seconds"`
+	Error      string     `json:"error,omitempty"`
+
+	ctime *time.Time // only for ProbeModule.Timestamp ctime
+}
+
+// statRoots returns the resolved roots the stat API may look into.
+func statRoots(roots string) ([]string, error) {
+	return resolveRoots(strings.Split(roots, ","))
+}
+
+// resolveRoots makes roots absolute and resolves their symlinks, so paths
+// can be compared to them lexically. Empty roots are left out.
+func resolveRoots(roots []string) ([]string, error) {
+	var resolved []string
+	for _, root := range roots {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		root, err = filepath.EvalSymlinks(root)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, root)
+	}
+	return resolved, nil
+}
+
+// withinRoots reports whether path is beneath one of roots.
+func withinRoots(roots []string, path string) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// stat measures a single path for the stat API.
+func (x *Exporter) stat(path string) statResult {
+	return x.statWithin(path, x.statRoots, TimestampMtime)
+}
+
+// statWithin measures a single path beneath roots, with the age taken from
+// timestamp, a value of ProbeModule.Timestamp.
+func (x *Exporter) statWithin(path string, roots []string, timestamp string) statResult {
+	res := statResult{Path: path}
+	if !filepath.IsAbs(path) {
+		res.Error = statErrNotAbsolute
+		return res
+	}
+	// Checking the lexical path first keeps the response from telling
+	// whether files outside the roots exist.
+	if !withinRoots(roots, filepath.Clean(path)) {
+		res.Error = statErrOutsideRoots
+		return res
+	}
+	// Symlinks must be resolved, or a link inside a root would expose any
+	// file on the host.
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil && !withinRoots(roots, resolved) {
+		res.Error = statErrOutsideRoots
+		return res
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = stat(resolved)
+	}
+	if os.IsNotExist(err) {
+		return res
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	mtime := fi.ModTime()
+	res.Exists = true
+	res.Mtime = &mtime
+	res.Size = fi.Size()
+	res.AgeSeconds = x.since(mtime).Seconds()
+	if timestamp == TimestampCtime {
+		ct, ok := ctime(fi)
+		if !ok {
+			res.Error = statErrNoCtime
+			return res
+		}
+		res.ctime = &ct
+		res.AgeSeconds = x.since(ct).Seconds()
+	}
+	return res
+}
+
+// statHandler reports mtime, size and age of a JSON list of paths, for
+// on-demand checks of files that are not monitored permanently.
+func (x *Exporter) statHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var paths []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, statMaxBody)).Decode(&paths); err != nil {
+		http.Error(w, "expected a JSON list of paths: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(paths) > statMaxPaths {
+		http.Error(w, "too many paths", http.StatusRequestEntityTooLarge)
+		return
+	}
+	results := make([]statResult, len(paths))
+	for i, path := range paths {
+		results[i] = x.stat(path)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,73 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+// States of the monitored process as exported by update_state.
+const (
+	// StateUnknown means neither start nor end file have been seen.
+	StateUnknown = "unknown"
+	// StateFresh means the last update finished within the health timeout.
+	StateFresh = "fresh"
+	// StateRunning means an update run has started and not finished yet.
+	StateRunning = "running"
+	// StateStale means the last update finished longer than the health
+	// timeout ago and no run is in progress.
+	StateStale = "stale"
+	// StateStuck means an update run is in progress for longer than the
+	// maximum plausible duration.
+	StateStuck = "stuck"
+)
+
+var states = []string{StateUnknown, StateFresh, StateRunning, StateStale, StateStuck}
+
+// state derives the current state from the last measurement.
+func (j *job) state() string {
+	j.mu.RLock()
+	start, end := j.start, j.end
+	if j.acked.After(end) {
+		end = j.acked
+	}
+	vanished := j.backendError[backendErrorDirectoryMissing]
+	j.mu.RUnlock()
+
+	switch {
+	case vanished && j.c.DirectoryRemoved == DirectoryRemovedStale:
+		return StateStale
+	case vanished:
+		return StateUnknown
+	case !start.IsZero() && (end.IsZero() || start.After(end)):
+		if j.c.MaxDuration > 0 && j.x.since(start) > j.c.MaxDuration {
+			return StateStuck
+		}
+		return StateRunning
+	case end.IsZero():
+		return StateUnknown
+	case j.x.since(end) < j.c.HealthTimeout:
+		return StateFresh
+	default:
+		return StateStale
+	}
+}
+
+// setState sets the update_state gauge of state to 1 and all others to 0.
+func (j *job) setState(state string) {
+	for _, s := range states {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		j.promUpdateState.WithLabelValues(s).Set(v)
+	}
+}
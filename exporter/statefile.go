@@ -0,0 +1,297 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// stateFileVersion is the version of the state file format.
+const stateFileVersion = 1
+
+// stateFile is what Config.StateFile holds: the counters and last run of
+// each job, by job name, so restarts neither reset counters nor take runs
+// that finished meanwhile for history. Jobs is a map[string]jobState, kept
+// raw to verify its checksum.
+type stateFile struct {
+	Version int             `json:"version"`
+	SHA256  string          `json:"sha256,omitempty"`
+	Jobs    json.RawMessage `json:"jobs"`
+}
+
+type jobState struct {
+	UpdateCount         float64       `json:"update_count"`
+	UpdateStarted       float64       `json:"update_started"`
+	ImplausibleDuration float64       `json:"implausible_duration"`
+	EndHeartbeats       float64       `json:"end_heartbeats"`
+	Start               time.Time     `json:"start"`
+	End                 time.Time     `json:"end"`
+	CountedEnd          time.Time     `json:"counted_end"`
+	LastRunStart        time.Time     `json:"last_run_start"`
+	LastDuration        time.Duration `json:"last_duration"`
+	Updated             bool          `json:"updated"`
+}
+
+// loadState reads the state file. A missing file is no error.
+func (x *Exporter) loadState() error {
+	x.state = make(map[string]jobState)
+	b, err := os.ReadFile(x.c.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if b, err = decompressState(x.c.StateFile, b); err != nil {
+		return err
+	}
+	var sf stateFile
+	if err := json.Unmarshal(b, &sf); err != nil {
+		return err
+	}
+	if sf.Version != stateFileVersion {
+		return errors.New("unknown state file version")
+	}
+	if sf.SHA256 != "" {
+		if sum := sha256.Sum256(sf.Jobs); hex.EncodeToString(sum[:]) != sf.SHA256 {
+			return errors.New("state file checksum mismatch")
+		}
+	}
+	jobs := make(map[string]jobState)
+	if err := json.Unmarshal(sf.Jobs, &jobs); err != nil {
+		return err
+	}
+	x.state = jobs
+	return nil
+}
+
+// stateChanged marks the state to be saved by the next heartbeat of
+// saveStateLoop. It must not be called with the mutex of a job held.
+func (x *Exporter) stateChanged() {
+	if x.c.StateFile == "" {
+		return
+	}
+	x.stateMu.Lock()
+	x.stateDirty = true
+	x.stateMu.Unlock()
+}
+
+// keepState records the state of the closed job j for the job replacing it.
+func (x *Exporter) keepState(j *job) {
+	if x.c.StateFile == "" {
+		return
+	}
+	x.stateMu.Lock()
+	defer x.stateMu.Unlock()
+	x.state[j.c.Name] = j.snapshot()
+}
+
+// saveStateLoop saves the state every heartbeatInterval if it changed, so
+// bursts of fs events write the state file once. It returns once the
+// exporter is closed, which saves the state a last time.
+func (x *Exporter) saveStateLoop() {
+	defer close(x.stateLoop)
+	tick := time.NewTicker(heartbeatInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			x.saveState(x.currentJobs())
+		case <-x.done:
+			return
+		}
+	}
+}
+
+// saveState writes the state of jobs to the state file if it changed. The
+// state of jobs that are gone is dropped. It replaces the file atomically,
+// so a crash leaves either the old or the new state. It must not be called
+// with the mutex of a job held.
+func (x *Exporter) saveState(jobs []*job) {
+	x.stateMu.Lock()
+	defer x.stateMu.Unlock()
+	if !x.stateDirty {
+		return
+	}
+	state := make(map[string]jobState, len(jobs))
+	for _, j := range jobs {
+		state[j.c.Name] = j.snapshot()
+	}
+	x.state = state
+	b, err := json.Marshal(state)
+	if err == nil {
+		sum := sha256.Sum256(b)
+		b, err = json.Marshal(stateFile{Version: stateFileVersion, SHA256: hex.EncodeToString(sum[:]), Jobs: b})
+	}
+	if err == nil {
+		b, err = compressState(x.c.StateFile, b)
+	}
+	if err == nil {
+		err = writeFileAtomic(x.c.StateFile, b)
+	}
+	if err != nil {
+		// Kept dirty to retry with the next heartbeat.
+		x.log.Printf("Error writing state file: %v", err)
+		return
+	}
+	x.stateDirty = false
+}
+
+// savedState returns the saved state of the job name, if any.
+func (x *Exporter) savedState(name string) (jobState, bool) {
+	if x.c.StateFile == "" {
+		return jobState{}, false
+	}
+	x.stateMu.Lock()
+	defer x.stateMu.Unlock()
+	st, ok := x.state[name]
+	return st, ok
+}
+
+// compressState compresses b by the extension of name: gzip for ".gz",
+// zstd for ".zst", none otherwise.
+func compressState(name string, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		w = gzip.NewWriter(&buf)
+	case strings.HasSuffix(name, ".zst"):
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return b, nil
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressState reverses compressState.
+func decompressState(name string, b []byte) ([]byte, error) {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case strings.HasSuffix(name, ".zst"):
+		r, err := zstd.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return b, nil
+	}
+}
+
+// writeFileAtomic writes b to a temporary file next to name and renames it
+// into place.
+func writeFileAtomic(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// snapshot returns the state of j to persist.
+func (j *job) snapshot() jobState {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return jobState{
+		UpdateCount:         counterValue(j.promUpdateCount),
+		UpdateStarted:       counterValue(j.promUpdateStarted),
+		ImplausibleDuration: counterValue(j.promImplausibleDuration),
+		EndHeartbeats:       counterValue(j.promEndHeartbeats),
+		Start:               j.oldStart,
+		End:                 j.oldEnd,
+		CountedEnd:          j.countedEnd,
+		LastRunStart:        j.lastRunStart,
+		LastDuration:        j.lastDuration,
+		Updated:             j.updated,
+	}
+}
+
+// restore continues from the saved state st. Runs that ended while the
+// exporter was down are counted by the first update.
+func (j *job) restore(st jobState) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.promUpdateCount.Add(st.UpdateCount)
+	j.promUpdateStarted.Add(st.UpdateStarted)
+	j.promImplausibleDuration.Add(st.ImplausibleDuration)
+	j.promEndHeartbeats.Add(st.EndHeartbeats)
+	j.oldStart, j.oldEnd, j.countedEnd = st.Start, st.End, st.CountedEnd
+	j.lastRunStart, j.updated = st.LastRunStart, st.Updated
+	if !st.CountedEnd.IsZero() {
+		j.promLastRunEnd.Set(float64(st.CountedEnd.UnixNano()) / 1e9)
+	}
+	if !st.LastRunStart.IsZero() {
+		j.promLastRunStart.Set(float64(st.LastRunStart.UnixNano()) / 1e9)
+	}
+	if st.LastDuration > 0 {
+		j.lastDuration, j.durationSet = st.LastDuration, true
+		j.promLastDuration.Set(st.LastDuration.Seconds())
+	}
+	j.resumed = true
+}
+
+// counterValue returns the current value of c.
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,74 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// synthesize simulates update runs by touching the job's own start and end
+// files: a run starts every SyntheticInterval and finishes SyntheticDuration
+// later. As the files are watched like any other, the whole pipeline from fs
+// events to metrics and health is exercised.
+func (j *job) synthesize() {
+	for _, file := range []string{j.startFile, j.endFile} {
+		if file == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			j.x.log.Printf("%sError creating directory for synthetic runs: %v", j.prefix(), err)
+		}
+	}
+	j.loops.Add(1)
+	go func() {
+		defer j.loops.Done()
+		tick := time.NewTicker(j.c.SyntheticInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-j.done:
+				return
+			case <-tick.C:
+			}
+			j.touch(j.startFile)
+			select {
+			case <-j.done:
+				return
+			case <-time.After(j.c.SyntheticDuration):
+			}
+			j.touch(j.endFile)
+		}
+	}()
+}
+
+// touch creates file or sets its mtime to now.
+func (j *job) touch(file string) {
+	if file == "" {
+		return
+	}
+	now := time.Now()
+	err := os.Chtimes(file, now, now)
+	if os.IsNotExist(err) {
+		var f *os.File
+		if f, err = os.Create(file); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		j.x.log.Printf("%sError touching %s for a synthetic run: %v", j.prefix(), file, err)
+	}
+}
@@ -0,0 +1,135 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdListenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const sdListenFdsStart = 3
+
+// Listen returns the listener for the server of c. If the exporter has been
+// started by systemd socket activation, it is the socket passed by systemd
+// and c.Listen is ignored, otherwise a new TCP listener on c.Listen.
+func Listen(c *Config) (net.Listener, error) {
+	l, err := systemdListener()
+	if err != nil || l != nil {
+		return l, err
+	}
+	return net.Listen("tcp", c.Listen)
+}
+
+// systemdListener returns the socket passed by systemd, or nil if there is
+// none. See sd_listen_fds(3).
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n == 0 {
+		return nil, nil
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets, expected one", n)
+	}
+	// Child processes must not think the socket was meant for them.
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(v)
+	}
+	f := os.NewFile(sdListenFdsStart, "LISTEN_FD_3")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("using socket passed by systemd: %w", err)
+	}
+	return l, nil
+}
+
+// NotifySystemd tells systemd that the exporter is ready, i.e. its files are
+// watched, and if systemd asks for it, starts sending watchdog keep-alives
+// for as long as all watch loops are alive and the exporter isn't closed.
+// It does nothing unless the exporter runs as a systemd service of
+// Type=notify. See sd_notify(3).
+func (x *Exporter) NotifySystemd() {
+	if err := sdNotify("READY=1"); err != nil {
+		x.log.Printf("Error notifying systemd: %v", err)
+	}
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	// Pinging at half the interval tolerates one late ping.
+	interval := time.Duration(usec) * time.Microsecond / 2
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-x.done:
+				return
+			}
+			if !x.watchLoopsAlive() {
+				x.log.Printf("A watch loop stalled, withholding systemd watchdog keep-alive")
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				x.log.Printf("Error notifying systemd watchdog: %v", err)
+			}
+		}
+	}()
+}
+
+// NotifySystemdStopping tells systemd that the exporter is shutting down.
+func NotifySystemdStopping() {
+	_ = sdNotify("STOPPING=1")
+}
+
+// watchLoopsAlive reports whether the watch loops of all jobs are alive.
+func (x *Exporter) watchLoopsAlive() bool {
+	for _, j := range x.currentJobs() {
+		if !j.loopAlive() {
+			return false
+		}
+	}
+	return true
+}
+
+// sdNotify sends state to the socket systemd passed in NOTIFY_SOCKET. It
+// does nothing if there is none.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// The net package maps a leading @ to the abstract namespace.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,65 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// pathVars are the variables available in templated file names.
+type pathVars struct {
+	// NodeName is the host name as reported by the kernel.
+	NodeName string
+	// Env holds the process environment.
+	Env map[string]string
+}
+
+func newPathVars() (pathVars, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return pathVars{}, err
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	return pathVars{NodeName: hostname, Env: env}, nil
+}
+
+// expandPath resolves text/template actions in a file name, e.g.
+// "/alloc/data/{{ .NodeName }}/done". Names without actions are returned
+// unchanged. Missing variables are an error rather than an empty string.
+func expandPath(name string) (string, error) {
+	if !strings.Contains(name, "{{") {
+		return name, nil
+	}
+	t, err := template.New("path").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("parsing file name template %q: %w", name, err)
+	}
+	vars, err := newPathVars()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("expanding file name template %q: %w", name, err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,122 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// tenant is the registry of the jobs of a tenant and how it is served.
+type tenant struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+	auth     *basicAuth // nil if the metrics are served without auth
+}
+
+// tenantName is what a tenant may be called, as it is part of a path.
+var tenantName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func validTenantName(name string) bool {
+	return tenantName.MatchString(name) && name != "." && name != ".."
+}
+
+// loadTenants reads the tenants of file and sets up their auth. Tenants keep
+// their registry across reloads, as the jobs that are kept stay registered.
+func (x *Exporter) loadTenants(file string) (map[string]*basicAuth, error) {
+	tenants, err := LoadTenants(file)
+	if err != nil {
+		return nil, err
+	}
+	auths := make(map[string]*basicAuth, len(tenants))
+	for name, t := range tenants {
+		auths[name] = nil
+		if t.BasicAuthFile == "" {
+			continue
+		}
+		// The endpoints don't matter, the tenant's metrics always need auth.
+		auths[name], err = newBasicAuth(t.BasicAuthFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: tenant %q: %w", file, name, err)
+		}
+	}
+	return auths, nil
+}
+
+// setTenantAuth replaces the auth of all tenants by auths. Must be called
+// with x.mu held.
+func (x *Exporter) setTenantAuth(auths map[string]*basicAuth) {
+	for name, auth := range auths {
+		x.tenant(name).auth = auth
+	}
+	for name, t := range x.tenants {
+		if _, ok := auths[name]; !ok {
+			t.auth = nil
+		}
+	}
+}
+
+// tenant returns the tenant called name, creating it on first use. Must be
+// called with x.mu held.
+func (x *Exporter) tenant(name string) *tenant {
+	if t, ok := x.tenants[name]; ok {
+		return t
+	}
+	if x.tenants == nil {
+		x.tenants = make(map[string]*tenant)
+	}
+	r := prometheus.NewRegistry()
+	t := &tenant{registry: r, handler: promhttp.HandlerFor(r, promhttp.HandlerOpts{})}
+	x.tenants[name] = t
+	return t
+}
+
+// tenantRegisterer returns where the metrics of the jobs of tenant name are
+// registered, the exporter's registerer if name is empty.
+func (x *Exporter) tenantRegisterer(name string) prometheus.Registerer {
+	if name == "" {
+		return x.registerer()
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.tenant(name).registry
+}
+
+// tenantHandler serves the metrics of the tenant named by the path below
+// the tenant endpoint, e.g. /tenants/team-a/metrics.
+func (x *Exporter) tenantHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, x.c.TenantEndpoint), "/metrics")
+	x.mu.RLock()
+	t, known := x.tenants[name]
+	var auth *basicAuth
+	if known {
+		auth = t.auth
+	}
+	x.mu.RUnlock()
+	if !ok || !known {
+		http.Error(w, fmt.Sprintf("unknown tenant %q", name), http.StatusNotFound)
+		return
+	}
+	if auth != nil {
+		auth.require(t.handler.ServeHTTP)(w, r)
+		return
+	}
+	t.handler.ServeHTTP(w, r)
+}
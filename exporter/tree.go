@@ -0,0 +1,237 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exporter
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// In recursive mode the end file is a directory, and the newest file
+// anywhere beneath it counts as the end file. As inotify doesn't watch
+// recursively, every directory of the tree is watched on its own, and
+// directories created later are added as their events arrive.
+//
+// Walking a large tree on every event would turn a busy tree into an IO
+// storm, so the newest file is tracked by the events instead, see
+// treeChanged. The tree is only walked at startup, on rescans, after a
+// watched directory vanished or appeared and when the newest file itself is
+// gone or got older.
+
+// treeState is what the watch loop knows about the tree between walks.
+type treeState struct {
+	newest treeFile
+	err    error // of the last walk
+	// walk is set if newest is unknown and the tree has to be walked.
+	walk bool
+	// statsStale is set if events changed the tree since the last walk, so
+	// the tree stats of Job.TopFiles are refreshed by the next heartbeat.
+	statsStale bool
+}
+
+// newestInTree returns the newest file of the tree, walking it if
+// j.tree.walk is set. Walks also return the tree stats if Job.TopFiles is
+// set.
+func (j *job) newestInTree(pace *pacer) (mtime time.Time, path string, stats *treeStats, err error) {
+	if !j.tree.walk {
+		return j.tree.newest.mtime, j.tree.newest.path, nil, j.tree.err
+	}
+	if j.c.TopFiles > 0 {
+		stats = &treeStats{n: j.topFiles()}
+	}
+	mtime, path, err = measureTree(j.endFile, j.c.Ignore, pace, stats)
+	j.tree = treeState{newest: treeFile{path: path, mtime: mtime}, err: err}
+	return mtime, path, stats, err
+}
+
+// treeChanged updates the newest file of the tree by the event e. A new or
+// changed file is stated on its own, a directory moved into the tree is
+// walked on its own, and only if the newest file is gone or got older the
+// whole tree has to be walked.
+func (j *job) treeChanged(e fsnotify.Event) {
+	j.tree.statsStale = j.c.TopFiles > 0
+	newest := j.tree.newest.path
+	within := newest != "" && (newest == e.Name || strings.HasPrefix(newest, e.Name+string(filepath.Separator)))
+	if within && e.Has(fsnotify.Remove|fsnotify.Rename) {
+		j.tree.walk = true
+		return
+	}
+	fi, err := stat(e.Name)
+	if err != nil {
+		j.tree.walk = j.tree.walk || within
+		return
+	}
+	f := treeFile{path: e.Name, mtime: fi.ModTime(), size: fi.Size()}
+	if fi.IsDir() {
+		f.mtime, f.path, _ = measureTree(e.Name, j.c.Ignore, nil, nil)
+	}
+	switch {
+	case f.mtime.After(j.tree.newest.mtime):
+		j.tree.newest = f
+	case f.path == newest && f.mtime.Before(j.tree.newest.mtime):
+		// The newest file got older, another one may be newer now.
+		j.tree.walk = true
+	}
+}
+
+// addTree watches all directories beneath root. Errors are logged and
+// skipped, so a single unreadable directory doesn't blind the whole tree.
+func (j *job) addTree(w watcher, root string) {
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			j.x.log.Printf("%sError walking %s: %v", j.prefix(), path, err)
+			return nil
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if j.c.Ignore.match(path) {
+			return fs.SkipDir
+		}
+		if err := w.Add(path); err != nil {
+			j.x.log.Printf("%sError watching directory %s: %v", j.prefix(), path, err)
+		}
+		return nil
+	})
+}
+
+// treeEvent handles an event in a watched tree. New directories are watched
+// including everything already created in them.
+func (j *job) treeEvent(w watcher, e fsnotify.Event) {
+	if !e.Has(fsnotify.Create) || j.c.Ignore.match(e.Name) {
+		return
+	}
+	stat, err := os.Stat(e.Name)
+	if err != nil || !stat.IsDir() {
+		return
+	}
+	if err := w.Add(e.Name); err != nil {
+		j.x.log.Printf("%sError watching directory %s: %v", j.prefix(), e.Name, err)
+	}
+	j.addTree(w, e.Name)
+}
+
+// measureTree returns the mtime and path of the newest file beneath root
+// that isn't ignored. In case of error or an empty tree returns zero
+// time.Time. walkErr is the first error other than a missing file. pace paces
+// the stat calls. If stats is not nil, all files are added to it.
+func measureTree(root string, ignore Patterns, pace *pacer, stats *treeStats) (mtime time.Time, path string, walkErr error) {
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if walkErr == nil {
+				walkErr = ignoreNotExist(err)
+			}
+			return nil
+		}
+		if p != root && ignore.match(p) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		pace.step()
+		info, err := d.Info()
+		if err != nil {
+			if walkErr == nil {
+				walkErr = ignoreNotExist(err)
+			}
+			return nil
+		}
+		if info.ModTime().After(mtime) {
+			mtime, path = info.ModTime(), p
+		}
+		stats.add(treeFile{path: p, mtime: info.ModTime(), size: info.Size()})
+		return nil
+	})
+	return
+}
+
+// treeStats aggregates the files of a tree and keeps its top files, so huge
+// trees can be inspected without a series per file. See Job.TopFiles.
+type treeStats struct {
+	n       int
+	files   int
+	size    int64
+	oldest  []treeFile // by mtime, oldest first
+	largest []treeFile // by size, largest first
+}
+
+type treeFile struct {
+	path  string
+	mtime time.Time
+	size  int64
+}
+
+func (t *treeStats) add(f treeFile) {
+	if t == nil {
+		return
+	}
+	t.files++
+	t.size += f.size
+	t.oldest = insertTop(t.oldest, f, t.n, func(a, b treeFile) bool { return a.mtime.Before(b.mtime) })
+	t.largest = insertTop(t.largest, f, t.n, func(a, b treeFile) bool { return a.size > b.size })
+}
+
+// insertTop inserts f into top, which is ordered by less, keeping at most n
+// files.
+func insertTop(top []treeFile, f treeFile, n int, less func(a, b treeFile) bool) []treeFile {
+	i := sort.Search(len(top), func(i int) bool { return less(f, top[i]) })
+	if i >= n {
+		return top
+	}
+	top = append(top, treeFile{})
+	copy(top[i+1:], top[i:])
+	top[i] = f
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// lowResourceTopFiles caps Job.TopFiles with Config.LowResource.
+const lowResourceTopFiles = 3
+
+// topFiles returns how many of the oldest and largest files the tree stats
+// keep.
+func (j *job) topFiles() int {
+	if j.x.c.LowResource {
+		return min(j.c.TopFiles, lowResourceTopFiles)
+	}
+	return j.c.TopFiles
+}
+
+// setTreeStats exports stats. Must be called with j.mu held.
+func (j *job) setTreeStats(stats *treeStats) {
+	j.promTreeFiles.Set(float64(stats.files))
+	j.promTreeSize.Set(float64(stats.size))
+	j.promTreeOldest.Reset()
+	for i, f := range stats.oldest {
+		j.promTreeOldest.WithLabelValues(strconv.Itoa(i+1), f.path).Set(float64(f.mtime.UnixNano()) / 1e9)
+	}
+	j.promTreeLargest.Reset()
+	for i, f := range stats.largest {
+		j.promTreeLargest.WithLabelValues(strconv.Itoa(i+1), f.path).Set(float64(f.size))
+	}
+}
@@ -0,0 +1,368 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+// Package exportertest spins up an Exporter against a temporary directory
+// with a fake clock and a private registry, to test integrations with the
+// exporter without real sleeps.
+package exportertest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/jwkohnen/prometheus_fileage_exporter/exporter"
+)
+
+// Epoch is the time a new Clock starts at.
+var Epoch = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Timeout is how long Touch and Remove wait for the exporter to observe
+// the change.
+var Timeout = 5 * time.Second
+
+// Clock is a fake clock that only moves when told to. It is safe for
+// concurrent use.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock set to t.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Harness is an Exporter under test.
+type Harness struct {
+	// Dir is the temporary directory the start and end file are in.
+	Dir      string
+	Clock    *Clock
+	Registry *prometheus.Registry
+	Config   *exporter.Config
+	Exporter *exporter.Exporter
+
+	t       testing.TB
+	handler http.Handler
+	scratch string // files are prepared here before moving them into Dir
+}
+
+// New starts an exporter watching the files "start" and "end" in a
+// temporary directory, with health and liveness timeouts of ten minutes and
+// no welpenschutz. configure, if not nil, may change the config before the
+// exporter is started. The exporter is closed when the test ends.
+func New(t testing.TB, configure func(c *exporter.Config)) *Harness {
+	t.Helper()
+	dir := t.TempDir()
+	h := &Harness{
+		Dir:      dir,
+		Clock:    NewClock(Epoch),
+		Registry: prometheus.NewRegistry(),
+		t:        t,
+		scratch:  t.TempDir(),
+	}
+	h.Config = &exporter.Config{
+		Job: exporter.Job{
+			StartFile:       filepath.Join(dir, "start"),
+			EndFile:         filepath.Join(dir, "end"),
+			HealthTimeout:   10 * time.Minute,
+			LivenessTimeout: 10 * time.Minute,
+		},
+		PromEndpoint:      "/metrics",
+		HealthEndpoint:    "/healthz",
+		LivenessEndpoint:  "/liveness",
+		ReadinessEndpoint: "/readyz",
+		StartupEndpoint:   "/startupz",
+		ReloadEndpoint:    "/-/reload",
+		AckEndpoint:       "/-/ack",
+		SnoozeEndpoint:    "/-/snooze",
+		TenantEndpoint:    "/tenants/",
+		SelftestEndpoint:  "/-/selftest",
+		StatEndpoint:      "/api/v1/stat",
+		ProbeEndpoint:     "/probe",
+		DirectoryTimeout:  10 * time.Second,
+		Registerer:        h.Registry,
+		Now:               h.Clock.Now,
+	}
+	if configure != nil {
+		configure(h.Config)
+	}
+	log := &logger{t: t}
+	var err error
+	h.Exporter, err = exporter.NewWithLogger(h.Config, log)
+	if err != nil {
+		log.stop()
+		t.Fatal(err)
+	}
+	h.handler = exporter.NewDefaultServer(h.Exporter, nil).Handler
+	t.Cleanup(func() {
+		h.Exporter.Close()
+		log.stop()
+	})
+	return h
+}
+
+// Path returns the absolute path of name in Dir.
+func (h *Harness) Path(name string) string {
+	return filepath.Join(h.Dir, name)
+}
+
+// Touch creates the file name in Dir or sets its mtime to the clock's
+// current time and waits until the exporter has observed it. name must be a
+// configured start or end file, match one that is a glob pattern or be in a
+// recursive end tree. For the latter two Touch waits until the newest file
+// is at least as new, as an existing newer file still counts.
+func (h *Harness) Touch(name string) {
+	h.t.Helper()
+	path := h.Path(name)
+	watched := h.watchedAs(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		h.t.Fatal(err)
+	}
+	// The file is moved into place with its final mtime, as the exporter
+	// would otherwise observe the real time of writing it.
+	tmp := filepath.Join(h.scratch, "touch")
+	if err := os.WriteFile(tmp, nil, 0o644); err != nil {
+		h.t.Fatal(err)
+	}
+	now := h.Clock.Now()
+	if err := os.Chtimes(tmp, now, now); err != nil {
+		h.t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		h.t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	want := float64(fi.ModTime().UnixNano()) / 1e9
+	h.wait("mtime of "+path+" to be exported", func() bool {
+		v, ok := h.lookup("file_mtime_timestamp_seconds", "path", watched)
+		return ok && (v == want || watched != path && v > want)
+	})
+}
+
+// Remove removes the file name in Dir and waits until the exporter has
+// observed the removal. For a glob pattern or recursive end tree that means
+// the newest file is another one, if any.
+func (h *Harness) Remove(name string) {
+	h.t.Helper()
+	path := h.Path(name)
+	watched := h.watchedAs(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	mtime := float64(fi.ModTime().UnixNano()) / 1e9
+	if err := os.Remove(path); err != nil {
+		h.t.Fatal(err)
+	}
+	h.wait("removal of "+path+" to be observed", func() bool {
+		v, ok := h.lookup("file_mtime_timestamp_seconds", "path", watched)
+		return !ok || watched != path && v != mtime
+	})
+}
+
+// watchedAs returns the configured start or end file that path is measured
+// as, i.e. the label path of its metrics. The test fails if there is none.
+func (h *Harness) watchedAs(path string) string {
+	h.t.Helper()
+	jobs := h.Config.Jobs
+	if len(jobs) == 0 {
+		jobs = []exporter.Job{h.Config.Job}
+	}
+	for _, job := range jobs {
+		for i, file := range []string{job.StartFile, job.EndFile} {
+			if file == "" {
+				continue
+			}
+			file, err := filepath.Abs(file)
+			if err != nil {
+				h.t.Fatal(err)
+			}
+			if matched, _ := filepath.Match(file, path); matched {
+				return file
+			}
+			tree := i == 1 && job.EndRecursive
+			if rel, err := filepath.Rel(file, path); tree && err == nil && !strings.HasPrefix(rel, "..") {
+				return file
+			}
+		}
+	}
+	h.t.Fatalf("%s is not a configured start or end file", path)
+	return ""
+}
+
+// Get serves a GET request for path, e.g. "/healthz", and returns the
+// status code and body of the response.
+func (h *Harness) Get(path string) (int, string) {
+	h.t.Helper()
+	rec := httptest.NewRecorder()
+	h.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	body, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return rec.Code, string(body)
+}
+
+// Value scrapes the exporter and returns the value of the metric name,
+// without namespace and subsystem, whose labels include the given label
+// name and value pairs. For summaries it returns the sample count. The test
+// fails if there is no such metric.
+func (h *Harness) Value(name string, labels ...string) float64 {
+	h.t.Helper()
+	v, ok := h.lookup(name, labels...)
+	if !ok {
+		h.t.Fatalf("no metric %s%v", name, labels)
+	}
+	return v
+}
+
+// Has scrapes the exporter and reports whether there is a metric name whose
+// labels include the given label name and value pairs, see Value.
+func (h *Harness) Has(name string, labels ...string) bool {
+	h.t.Helper()
+	_, ok := h.lookup(name, labels...)
+	return ok
+}
+
+// lookup is like Value, but reports whether the metric was found.
+func (h *Harness) lookup(name string, labels ...string) (float64, bool) {
+	h.t.Helper()
+	if len(labels)%2 != 0 {
+		h.t.Fatalf("odd number of label names and values: %v", labels)
+	}
+	// Scraping updates the metrics that are computed at scrape time.
+	if code, body := h.Get(h.Config.PromEndpoint); code != http.StatusOK {
+		h.t.Fatalf("scrape failed with %d: %s", code, body)
+	}
+	families, err := h.Registry.Gather()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	name = prometheus.BuildFQName(h.Config.Namespace, h.Config.Subsystem, name)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if hasLabels(m, labels) {
+				return value(m), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func hasLabels(m *dto.Metric, labels []string) bool {
+	for i := 0; i < len(labels); i += 2 {
+		found := false
+		for _, l := range m.GetLabel() {
+			if l.GetName() == labels[i] && l.GetValue() == labels[i+1] {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func value(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Summary != nil:
+		return float64(m.Summary.GetSampleCount())
+	case m.Histogram != nil:
+		return float64(m.Histogram.GetSampleCount())
+	}
+	return m.GetUntyped().GetValue()
+}
+
+// wait polls cond until it holds or Timeout has passed. fs events arrive
+// asynchronously, so this is the only place real time passes.
+func (h *Harness) wait(what string, cond func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// logger logs to the test until it is stopped, as logging after a test has
+// completed panics.
+type logger struct {
+	mu      sync.Mutex
+	t       testing.TB
+	stopped bool
+}
+
+func (l *logger) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+}
+
+func (l *logger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.stopped {
+		l.t.Logf(format, v...)
+	}
+}
+
+func (l *logger) Fatalf(format string, v ...interface{}) {
+	l.t.Fatalf(format, v...)
+}
+
+func (l *logger) Fatal(v ...interface{}) {
+	l.t.Fatal(v...)
+}
+
+func (l *logger) Fatalln(v ...interface{}) {
+	l.t.Fatal(fmt.Sprintln(v...))
+}
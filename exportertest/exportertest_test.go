@@ -0,0 +1,218 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exportertest_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/prometheus_fileage_exporter/exporter"
+	"github.com/jwkohnen/prometheus_fileage_exporter/exportertest"
+)
+
+func TestClock(t *testing.T) {
+	c := exportertest.NewClock(exportertest.Epoch)
+	c.Advance(time.Hour)
+	if got, want := c.Now(), exportertest.Epoch.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("Now() = %v, want %v", got, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	h := exportertest.New(t, nil)
+	h.Touch("start")
+	h.Clock.Advance(time.Minute)
+	h.Touch("end")
+	if got := h.Value("update_count_total"); got != 1 {
+		t.Errorf("update_count_total = %v, want 1", got)
+	}
+	if got := h.Value("last_update_duration_seconds"); got != 60 {
+		t.Errorf("last_update_duration_seconds = %v, want 60", got)
+	}
+	if code, body := h.Get("/healthz"); code != http.StatusOK {
+		t.Errorf("healthz = %d, want 200: %s", code, body)
+	}
+	h.Clock.Advance(11 * time.Minute)
+	if code, body := h.Get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("healthz = %d, want 503: %s", code, body)
+	}
+}
+
+func TestTransitionWithoutProbe(t *testing.T) {
+	h := exportertest.New(t, nil)
+	h.Touch("end")
+	h.Clock.Advance(11 * time.Minute)
+	// Any event re-evaluates health, like the heartbeat does. That happens
+	// right after the metrics Touch waits for, so poll.
+	h.Touch("start")
+	got := h.Value("health_transitions_total", "check", "health", "to", "bad")
+	for deadline := time.Now().Add(5 * time.Second); got != 1 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		got = h.Value("health_transitions_total", "check", "health", "to", "bad")
+	}
+	if got != 1 {
+		t.Errorf("health_transitions_total = %v, want 1", got)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	h := exportertest.New(t, nil)
+	h.Touch("end")
+	h.Remove("end")
+	if got := h.Value("file_exists", "path", h.Path("end")); got != 0 {
+		t.Errorf("file_exists = %v, want 0", got)
+	}
+}
+
+func TestTouchGlob(t *testing.T) {
+	h := exportertest.New(t, func(c *exporter.Config) {
+		c.EndFile = filepath.Join(filepath.Dir(c.EndFile), "*.done")
+	})
+	h.Touch("a.done")
+	h.Clock.Advance(time.Minute)
+	h.Touch("b.done")
+	if got := h.Value("glob_newest_match_info", "role", "end", "path", h.Path("b.done")); got != 1 {
+		t.Errorf("glob_newest_match_info = %v, want 1", got)
+	}
+	h.Remove("b.done")
+	if got := h.Value("glob_newest_match_info", "role", "end", "path", h.Path("a.done")); got != 1 {
+		t.Errorf("glob_newest_match_info after removal = %v, want 1", got)
+	}
+}
+
+func TestTouchTree(t *testing.T) {
+	h := exportertest.New(t, func(c *exporter.Config) {
+		c.StartFile = ""
+		c.EndFile = filepath.Dir(c.EndFile)
+		c.EndRecursive = true
+	})
+	h.Touch("sub/file")
+	if got := h.Value("glob_newest_match_info", "role", "end", "path", h.Path("sub/file")); got != 1 {
+		t.Errorf("glob_newest_match_info = %v, want 1", got)
+	}
+}
+
+func TestTreeRemoveNewest(t *testing.T) {
+	h := exportertest.New(t, func(c *exporter.Config) {
+		c.StartFile = ""
+		c.EndFile = filepath.Dir(c.EndFile)
+		c.EndRecursive = true
+	})
+	h.Touch("a/file")
+	h.Clock.Advance(time.Minute)
+	h.Touch("b/file")
+	if got := h.Value("glob_newest_match_info", "role", "end", "path", h.Path("b/file")); got != 1 {
+		t.Errorf("glob_newest_match_info = %v, want 1", got)
+	}
+	h.Remove("b/file")
+	if got := h.Value("glob_newest_match_info", "role", "end", "path", h.Path("a/file")); got != 1 {
+		t.Errorf("glob_newest_match_info after removal = %v, want 1", got)
+	}
+}
+
+func TestIgnoreTree(t *testing.T) {
+	h := exportertest.New(t, func(c *exporter.Config) {
+		dir := filepath.Dir(c.EndFile)
+		for _, name := range []string{".git/objects/x", "sub/upload.part", "sub/file"} {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, filepath.Join(dir, name), "")
+		}
+		c.StartFile = ""
+		c.EndFile = dir
+		c.EndRecursive = true
+		c.TopFiles = 3
+		c.Ignore = exporter.Patterns{".git", `re:\.part$`}
+	})
+	// The tree stats are refreshed by walks, the first one at startup.
+	got := h.Value("tree_files")
+	for deadline := time.Now().Add(5 * time.Second); got != 1 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		got = h.Value("tree_files")
+	}
+	if got != 1 {
+		t.Errorf("tree_files = %v, want 1", got)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	h := exportertest.New(t, func(c *exporter.Config) {
+		dir := filepath.Dir(c.EndFile)
+		c.ConfigFile = filepath.Join(t.TempDir(), "jobs.yaml")
+		writeFile(t, c.ConfigFile, "jobs:\n"+
+			"  - name: a\n    file_end: "+filepath.Join(dir, "a")+"\n"+
+			"  - name: b\n    file_end: "+filepath.Join(dir, "b")+"\n")
+	})
+	h.Touch("a")
+	if got := h.Value("file_exists", "job_name", "a"); got != 1 {
+		t.Errorf("file_exists of a = %v, want 1", got)
+	}
+	if got := h.Value("file_exists", "job_name", "b"); got != 0 {
+		t.Errorf("file_exists of b = %v, want 0", got)
+	}
+	code, body := h.Get("/healthz/a")
+	if code != http.StatusOK || !strings.Contains(body, "# job: a") {
+		t.Errorf("healthz/a = %d, want 200: %s", code, body)
+	}
+}
+
+func TestDirectoryRemoved(t *testing.T) {
+	for mode, state := range map[string]string{
+		exporter.DirectoryRemovedError: exporter.StateUnknown,
+		exporter.DirectoryRemovedStale: exporter.StateStale,
+	} {
+		t.Run(mode, func(t *testing.T) {
+			h := exportertest.New(t, func(c *exporter.Config) {
+				c.DirectoryRemoved = mode
+			})
+			h.Touch("end")
+			if code, body := h.Get("/healthz"); code != http.StatusOK {
+				t.Fatalf("healthz = %d, want 200: %s", code, body)
+			}
+			if err := os.RemoveAll(h.Dir); err != nil {
+				t.Fatal(err)
+			}
+			// Well before the health timeout of ten minutes.
+			code, body := h.Get("/healthz")
+			for deadline := time.Now().Add(5 * time.Second); code == http.StatusOK && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+				code, body = h.Get("/healthz")
+			}
+			if code != http.StatusServiceUnavailable {
+				t.Fatalf("healthz = %d, want 503: %s", code, body)
+			}
+			for _, want := range []string{"# state: " + state + "\r\n", "# error: a watched directory is missing\r\n"} {
+				if !strings.Contains(body, want) {
+					t.Errorf("healthz body lacks %q: %s", want, body)
+				}
+			}
+			if got := h.Value("backend_error_info", "reason", "directory_missing"); got != 1 {
+				t.Errorf("backend_error_info = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
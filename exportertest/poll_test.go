@@ -0,0 +1,110 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exportertest_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/prometheus_fileage_exporter/exporter"
+	"github.com/jwkohnen/prometheus_fileage_exporter/exportertest"
+)
+
+// withPolling makes the harness poll its directories instead of watching
+// them by fs notifications.
+func withPolling(c *exporter.Config) {
+	c.PollInterval = 10 * time.Millisecond
+}
+
+func TestPoll(t *testing.T) {
+	h := exportertest.New(t, withPolling)
+	h.Touch("start")
+	h.Clock.Advance(time.Minute)
+	h.Touch("end")
+	if got := h.Value("update_count_total"); got != 1 {
+		t.Errorf("update_count_total = %v, want 1", got)
+	}
+	h.Remove("end")
+	if got := h.Value("file_exists", "path", h.Path("end")); got != 0 {
+		t.Errorf("file_exists after removal = %v, want 0", got)
+	}
+}
+
+func TestPollTree(t *testing.T) {
+	h := exportertest.New(t, func(c *exporter.Config) {
+		withPolling(c)
+		c.StartFile = ""
+		c.EndFile = filepath.Dir(c.EndFile)
+		c.EndRecursive = true
+	})
+	h.Touch("a/file")
+	h.Clock.Advance(time.Minute)
+	h.Touch("b/c/file")
+	if got := h.Value("glob_newest_match_info", "role", "end", "path", h.Path("b/c/file")); got != 1 {
+		t.Errorf("glob_newest_match_info = %v, want 1", got)
+	}
+	h.Remove("b/c/file")
+	if got := h.Value("glob_newest_match_info", "role", "end", "path", h.Path("a/file")); got != 1 {
+		t.Errorf("glob_newest_match_info after removal = %v, want 1", got)
+	}
+}
+
+func TestPollDirectoryRemoved(t *testing.T) {
+	h := exportertest.New(t, withPolling)
+	h.Touch("end")
+	if err := os.RemoveAll(h.Dir); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !h.Has("backend_error_info", "reason", "directory_missing"); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the removal of the directory to be observed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := h.Value("backend_error_info", "reason", "directory_missing"); got != 1 {
+		t.Errorf("backend_error_info = %v, want 1", got)
+	}
+}
+
+func TestLowResourceTopFiles(t *testing.T) {
+	h := exportertest.New(t, func(c *exporter.Config) {
+		dir := filepath.Dir(c.EndFile)
+		for i := 0; i < 5; i++ {
+			writeFile(t, filepath.Join(dir, strconv.Itoa(i)), "")
+		}
+		c.StartFile = ""
+		c.EndFile = dir
+		c.EndRecursive = true
+		c.TopFiles = 5
+		c.LowResource = true
+	})
+	got := h.Value("tree_files")
+	for deadline := time.Now().Add(5 * time.Second); got != 5 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		got = h.Value("tree_files")
+	}
+	if got != 5 {
+		t.Fatalf("tree_files = %v, want 5", got)
+	}
+	if !h.Has("tree_oldest_file_mtime_timestamp_seconds", "rank", "3") {
+		t.Error("no third oldest file")
+	}
+	if h.Has("tree_oldest_file_mtime_timestamp_seconds", "rank", "4") {
+		t.Error("more than 3 oldest files with LowResource")
+	}
+}
@@ -0,0 +1,193 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exportertest_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/prometheus_fileage_exporter/exporter"
+	"github.com/jwkohnen/prometheus_fileage_exporter/exportertest"
+)
+
+// newReloadHarness starts a harness with jobs from a config file that
+// write replaces. jobs is the jobs section of the YAML file, where "DIR/"
+// stands for the directory of the harness. The jobs have no start file
+// unless they set one.
+func newReloadHarness(t *testing.T, jobs string, configure func(c *exporter.Config)) (*exportertest.Harness, func(jobs string)) {
+	t.Helper()
+	var write func(jobs string)
+	h := exportertest.New(t, func(c *exporter.Config) {
+		dir := filepath.Dir(c.EndFile)
+		c.StartFile = ""
+		c.ConfigFile = filepath.Join(t.TempDir(), "jobs.yaml")
+		write = func(jobs string) {
+			writeFile(t, c.ConfigFile, "jobs:\n"+strings.ReplaceAll(jobs, "DIR/", dir+"/"))
+		}
+		write(jobs)
+		if configure != nil {
+			configure(c)
+		}
+	})
+	return h, write
+}
+
+func TestReload(t *testing.T) {
+	h, write := newReloadHarness(t, ""+
+		"  - name: a\n    file_end: DIR/a\n"+
+		"  - name: b\n    file_end: DIR/b\n    health_timeout: 1h\n"+
+		"  - name: d\n    file_end: DIR/d\n", nil)
+	h.Touch("a")
+	h.Touch("b")
+	// The recreated job b finds its end file older than itself then, so it
+	// doesn't count it as a run.
+	h.Clock.Advance(time.Minute)
+
+	// a is unchanged, b is changed, c is added and d is removed.
+	write("" +
+		"  - name: a\n    file_end: DIR/a\n" +
+		"  - name: b\n    file_end: DIR/b\n    health_timeout: 2h\n" +
+		"  - name: c\n    file_end: DIR/c\n")
+	if err := h.Exporter.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Value("update_count_total", "job_name", "a"); got != 1 {
+		t.Errorf("update_count_total of the unchanged job = %v, want 1", got)
+	}
+	if got := h.Value("update_count_total", "job_name", "b"); got != 0 {
+		t.Errorf("update_count_total of the changed job = %v, want 0", got)
+	}
+	if !h.Has("file_exists", "job_name", "c") {
+		t.Error("the added job has no series")
+	}
+	if h.Has("file_exists", "job_name", "d") {
+		t.Error("the removed job still has series")
+	}
+	if code, body := h.Get("/healthz/b"); !strings.Contains(body, "threshold: 2h0m0s") {
+		t.Errorf("healthz/b = %d, want threshold 2h0m0s: %s", code, body)
+	}
+	if code, _ := h.Get("/healthz/d"); code != http.StatusNotFound {
+		t.Errorf("healthz/d = %d, want 404", code)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	h, write := newReloadHarness(t, "  - name: a\n    file_end: DIR/a\n", nil)
+	h.Touch("a")
+
+	write("  - name: a\n    file_end: DIR/a\n  - name: b\n    file_end: DIR/b\n    health_welpenschutz_mode: bogus\n")
+	if err := h.Exporter.Reload(); err == nil {
+		t.Fatal("reloading an invalid job succeeded")
+	}
+	if got := h.Value("config_error_info", "job_name", "a", "reason", "reload_failed"); got != 1 {
+		t.Errorf("config_error_info = %v, want 1", got)
+	}
+	if got := h.Value("update_count_total", "job_name", "a"); got != 1 {
+		t.Errorf("update_count_total = %v, want 1 of the previous configuration", got)
+	}
+
+	write("  - name: a\n    file_end: DIR/a\n")
+	if err := h.Exporter.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Has("config_error_info", "job_name", "a", "reason", "reload_failed") {
+		t.Error("config_error_info still set after a successful reload")
+	}
+}
+
+func TestReloadTemplatedPath(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	t.Setenv("FILEAGE_TEST_DIR", first)
+	h, _ := newReloadHarness(t, "  - name: a\n    file_end: '{{ .Env.FILEAGE_TEST_DIR }}/a'\n", nil)
+	if !h.Has("file_exists", "path", filepath.Join(first, "a")) {
+		t.Fatal("the job doesn't watch the first directory")
+	}
+
+	// The config file is the same, but it resolves to another file.
+	t.Setenv("FILEAGE_TEST_DIR", second)
+	if err := h.Exporter.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Has("file_exists", "path", filepath.Join(second, "a")) {
+		t.Error("the job doesn't watch the second directory after the reload")
+	}
+}
+
+func TestReloadFailedJob(t *testing.T) {
+	h, write := newReloadHarness(t, "  - name: a\n    file_end: DIR/a\n", func(c *exporter.Config) {
+		c.DirectoryTimeout = 100 * time.Millisecond
+	})
+
+	write("  - name: a\n    file_end: DIR/a\n  - name: b\n    file_end: DIR/missing/b\n")
+	if err := h.Exporter.Reload(); err == nil {
+		t.Fatal("reloading a job in a missing directory succeeded")
+	}
+	if got := h.Value("config_error_info", "job_name", "b", "reason", "reload_failed"); got != 1 {
+		t.Errorf("config_error_info of the failed job = %v, want 1", got)
+	}
+	if h.Has("config_error_info", "job_name", "a", "reason", "reload_failed") {
+		t.Error("config_error_info set for the job that was created")
+	}
+
+	write("  - name: a\n    file_end: DIR/a\n  - name: b\n    file_end: DIR/b\n")
+	if err := h.Exporter.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Has("config_error_info", "job_name", "b", "reason", "reload_failed") {
+		t.Error("config_error_info of the failed job remains after it was created")
+	}
+	if !h.Has("file_exists", "job_name", "b") {
+		t.Error("the job created by the second reload has no series")
+	}
+}
+
+func TestReloadConcurrent(t *testing.T) {
+	h, write := newReloadHarness(t, "  - name: a\n    file_end: DIR/a\n", nil)
+	h.Touch("a")
+	write("  - name: a\n    file_end: DIR/a\n  - name: b\n    file_end: DIR/b\n")
+
+	// Like SIGHUP and POST to the reload endpoint at the same time.
+	routes := h.Exporter.Routes()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := h.Exporter.Reload(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, h.Config.ReloadEndpoint, nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("POST %s = %d: %s", h.Config.ReloadEndpoint, rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := h.Value("update_count_total", "job_name", "a"); got != 1 {
+		t.Errorf("update_count_total = %v, want 1", got)
+	}
+	if !h.Has("file_exists", "job_name", "b") {
+		t.Error("the added job has no series")
+	}
+}
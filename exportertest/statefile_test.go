@@ -0,0 +1,134 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package exportertest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwkohnen/prometheus_fileage_exporter/exporter"
+	"github.com/jwkohnen/prometheus_fileage_exporter/exportertest"
+)
+
+// runAndClose completes a run of the harness's job and closes it, which
+// saves the state file.
+func runAndClose(h *exportertest.Harness) {
+	h.Touch("start")
+	h.Clock.Advance(time.Minute)
+	h.Touch("end")
+	h.Exporter.Close()
+}
+
+func TestStateFile(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		magic []byte
+	}{
+		{"state.json", []byte("{")},
+		{"state.json.gz", []byte{0x1f, 0x8b}},
+		{"state.json.zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tc.name)
+			withState := func(c *exporter.Config) { c.StateFile = file }
+
+			h := exportertest.New(t, withState)
+			h.Touch("start")
+			h.Clock.Advance(time.Minute)
+			h.Touch("end")
+			// Saving waits for the heartbeat or Close.
+			if _, err := os.Stat(file); err == nil {
+				t.Error("state file written right away")
+			}
+			h.Exporter.Close()
+			b, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(b, tc.magic) {
+				t.Errorf("state file starts with %x, want %x", b[:min(len(b), 4)], tc.magic)
+			}
+
+			h = exportertest.New(t, withState)
+			if got := h.Value("update_count_total"); got != 1 {
+				t.Errorf("restored update_count_total = %v, want 1", got)
+			}
+			if got := h.Value("last_update_duration_seconds"); got != 60 {
+				t.Errorf("restored last_update_duration_seconds = %v, want 60", got)
+			}
+		})
+	}
+}
+
+func TestStateFileChecksumMismatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	withState := func(c *exporter.Config) { c.StateFile = file }
+	runAndClose(exportertest.New(t, withState))
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := strings.Replace(string(b), `"update_count":1`, `"update_count":7`, 1)
+	if corrupt == string(b) {
+		t.Fatalf("no update count in the state file: %s", b)
+	}
+	writeFile(t, file, corrupt)
+
+	// A corrupt state file is ignored rather than keeping the exporter from
+	// starting.
+	h := exportertest.New(t, withState)
+	if got := h.Value("update_count_total"); got != 0 {
+		t.Errorf("update_count_total = %v, want 0", got)
+	}
+}
+
+func TestStateFileRemovedJob(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	h, write := newReloadHarness(t, ""+
+		"  - name: a\n    file_end: DIR/a\n"+
+		"  - name: b\n    file_end: DIR/b\n", func(c *exporter.Config) {
+		c.StateFile = file
+	})
+	h.Touch("a")
+	h.Touch("b")
+
+	write("  - name: a\n    file_end: DIR/a\n")
+	if err := h.Exporter.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	h.Exporter.Close()
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sf struct {
+		Jobs map[string]json.RawMessage `json:"jobs"`
+	}
+	if err := json.Unmarshal(b, &sf); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sf.Jobs["a"]; !ok {
+		t.Error("state of job a is missing")
+	}
+	if _, ok := sf.Jobs["b"]; ok {
+		t.Error("state of the removed job b is kept")
+	}
+}
@@ -15,50 +15,196 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/jwkohnen/prometheus_fileage_exporter/exporter"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "probe-local" {
+		os.Exit(probeLocal(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(bench(os.Args[2:], os.Stdout))
+	}
+
 	// Prepare logging
 	log := logrus.New()
 	log.Out = os.Stderr
 
-	cfg := configure(log)
-	xptr := exporter.NewExporterWithLogger(cfg, log)
-	srv := exporter.NewDefaultServer(xptr)
+	if len(os.Args) > 1 && serviceCommand(log, os.Args[1], os.Args[2:]) {
+		return
+	}
+
+	cfg := configure(log, os.Args[1:])
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
 	go func() {
-		defer signal.Stop(sig)
-		<-sig
-		_ = srv.Close()
+		s := <-sig
+		signal.Stop(sig)
+		log.Infof("Received %s, shutting down", s)
+		close(stop)
 	}()
 
-	err := srv.ListenAndServe()
+	serve(log, cfg, stop)
+}
+
+// serve runs the exporter until stop is closed, then drains connections and
+// returns.
+func serve(log *logrus.Logger, cfg *exporter.Config, stop <-chan struct{}) {
+	xptr := exporter.NewExporterWithLogger(cfg, log)
+	l, err := exporter.Listen(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := exporter.NewDefaultServer(xptr, l)
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-stop
+		exporter.NotifySystemdStopping()
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("Error draining connections: %v", err)
+			_ = srv.Close()
+		}
+		xptr.Close()
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := xptr.Reload(); err != nil {
+				log.Errorf("Error reloading config: %v", err)
+			}
+		}
+	}()
+
+	xptr.NotifySystemd()
+	err = srv.Serve()
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-drained
+}
+
+// lowResourcePollInterval is the poll interval of -low-resource, long
+// enough to hardly ever wake up a small device.
+const lowResourcePollInterval = time.Minute
+
+// configureLowResource applies the -low-resource profile for small devices
+// like ARM gateways: the go and process collectors are dropped from the
+// default registry, the exporter keeps smaller buffers, see
+// Config.LowResource, and unless -poll-interval is set the directories are
+// polled every minute instead of watched by fs notifications.
+func configureLowResource(config *exporter.Config) {
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	config.LowResource = true
+	if config.PollInterval == 0 {
+		config.PollInterval = lowResourcePollInterval
+	}
+}
+
+// envPrefix is prepended to flag names to get the name of the environment
+// variable that sets them, e.g. FILEAGE_FILE_END for -file-end.
+const envPrefix = "FILEAGE_"
+
+// setFlagsFromEnv sets flags from environment variables. It must be called
+// before the command line is parsed, so that flags given on the command line
+// take precedence.
+func setFlagsFromEnv(log *logrus.Logger) {
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok {
+			if err := f.Value.Set(v); err != nil {
+				log.Fatalf("Invalid value %q for %s: %v", v, name, err)
+			}
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				f.Value = &envOverride{Value: f.Value}
+			}
+		}
+	})
 }
 
-func configure(log *logrus.Logger) *exporter.Config {
+// envOverride wraps the value of a flag that was set from the environment,
+// so that the command line replaces it instead of adding to it, as
+// repeatable flags like -annotation would.
+type envOverride struct {
+	flag.Value
+	overridden bool
+}
+
+func (o *envOverride) String() string {
+	if o.Value == nil {
+		return ""
+	}
+	return o.Value.String()
+}
+
+func (o *envOverride) Set(s string) error {
+	if !o.overridden {
+		o.overridden = true
+		// Flag values are pointers to the variable they set.
+		if v := reflect.ValueOf(o.Value); v.Kind() == reflect.Pointer {
+			v.Elem().Set(reflect.Zero(v.Elem().Type()))
+		}
+	}
+	return o.Value.Set(s)
+}
+
+func configure(log *logrus.Logger, args []string) *exporter.Config {
 	config := &exporter.Config{}
+	flag.StringVar(&config.ConfigFile, "config", "",
+		"YAML file with a list of jobs to monitor; file and timeout flags are their defaults",
+	)
 	flag.StringVar(&config.StartFile, "file-start", "",
 		"the start file",
 	)
 	flag.StringVar(&config.EndFile, "file-end", "",
 		"the end-file",
 	)
+	flag.Var(&config.StartEvents, "file-start-events",
+		"comma separated fs events on the start file that trigger an update (create,write,remove,rename,chmod)",
+	)
+	flag.Var(&config.EndEvents, "file-end-events",
+		"comma separated fs events on the end file that trigger an update (create,write,remove,rename,chmod)",
+	)
+	flag.BoolVar(&config.EndRecursive, "file-end-recursive", false,
+		"the end file is a directory; the newest file anywhere beneath it counts as end file",
+	)
+	flag.Var(&config.Ignore, "ignore",
+		"comma separated glob patterns of file names, or regular expressions of paths prefixed with re:, to leave out of glob matches and recursive trees, e.g. *.tmp,.*",
+	)
+	flag.IntVar(&config.TopFiles, "file-end-top", 0,
+		"in recursive mode, export the N oldest and largest files of the tree along with its file count and size (0 disables)",
+	)
+	flag.BoolVar(&config.EndRequiresStart, "file-end-requires-start", false,
+		"count a change of the end file as an update run only if the start file changed since the last run; others are heartbeats that only refresh the age",
+	)
 	flag.StringVar(&config.Listen, "listen", ":9104",
-		"host:port to listen at",
+		"host:port to listen at, unless started by systemd socket activation",
+	)
+	flag.DurationVar(&config.DrainTimeout, "drain-timeout", 5*time.Second,
+		"on SIGTERM or interrupt, wait this long for in-flight requests to finish",
 	)
 	flag.StringVar(&config.PromEndpoint, "prom", "/metrics",
 		"publish prometheus metrics on this URL endpoint",
@@ -69,12 +215,90 @@ func configure(log *logrus.Logger) *exporter.Config {
 	flag.StringVar(&config.LivenessEndpoint, "liveness", "/liveness",
 		"publish liveness status on this URL endpoint",
 	)
+	flag.StringVar(&config.ReadinessEndpoint, "readiness", "/readyz",
+		"publish readiness, i.e. all directories are watched and the files measured, on this URL endpoint",
+	)
+	flag.BoolVar(&config.MetricsRequireReady, "metrics-require-ready", false,
+		"answer 503 on the metrics endpoint until the files of all jobs have been measured for the first time",
+	)
+	flag.StringVar(&config.StartupEndpoint, "startup", "/startupz",
+		"publish startup status, i.e. the end files have been found once, on this URL endpoint",
+	)
+	flag.StringVar(&config.HealthAggregate, "health-aggregate", exporter.HealthAggregateAny,
+		"whether the health endpoint reports unhealthy if \"any\" or only if \"all\" jobs are unhealthy",
+	)
+	flag.IntVar(&config.HealthFailureStatus, "health-failure-status", http.StatusServiceUnavailable,
+		"HTTP status code of failed health and liveness checks",
+	)
+	flag.DurationVar(&config.HealthRetryAfter, "health-retry-after", 0,
+		"Retry-After of failed health and liveness checks if the next update can't be estimated from the last runs (0 omits it)",
+	)
+	flag.StringVar(&config.LivenessMode, "liveness-mode", exporter.LivenessStaleness,
+		"what drives liveness: the \"staleness\" of the end file or only \"internal\" health of the exporter",
+	)
+	flag.StringVar(&config.AckEndpoint, "ack", "/-/ack",
+		"acknowledge a job as fresh on POST to this URL endpoint, if -basic-auth-file is set",
+	)
+	flag.StringVar(&config.TenantEndpoint, "tenant-metrics", "/tenants/",
+		"publish the metrics of each tenant below this URL endpoint, as <endpoint><tenant>/metrics",
+	)
+	flag.StringVar(&config.SnoozeEndpoint, "snooze", "/-/snooze",
+		"exclude a job from health aggregation and notifications for a while on POST to this URL endpoint, if -basic-auth-file is set",
+	)
+	flag.StringVar(&config.ReloadEndpoint, "reload", "/-/reload",
+		"re-read the config file on POST to this URL endpoint, if -config is set",
+	)
+	flag.StringVar(&config.SelftestEndpoint, "selftest", "/-/selftest",
+		"run a self-test on POST to this URL endpoint, if -selftest-dir is set",
+	)
+	flag.StringVar(&config.SelftestDir, "selftest-dir", "",
+		"scratch directory for self-tests of fs event delivery; empty disables the self-test",
+	)
+	flag.StringVar(&config.BasicAuthFile, "basic-auth-file", "",
+		"file with user:bcrypt-hash lines, as written by htpasswd -B; enables HTTP basic auth",
+	)
+	flag.StringVar(&config.BasicAuthEndpoints, "basic-auth-endpoints", "prom",
+		"comma separated endpoints that require basic auth (prom,health,liveness,readiness,startup,reload,selftest,stat,probe)",
+	)
+	flag.StringVar(&config.StatEndpoint, "stat-api", "/api/v1/stat",
+		"report mtime, size and age of a JSON list of paths POSTed to this URL endpoint, if -stat-roots is set",
+	)
+	flag.StringVar(&config.ProbeEndpoint, "probe", "/probe",
+		"serve metrics about the file given by the query parameter target on this URL endpoint, if -stat-roots or -config is set",
+	)
+	flag.StringVar(&config.StatRoots, "stat-roots", "",
+		"comma separated directories the stat API and probe endpoint may look into; empty disables both",
+	)
+	flag.StringVar(&config.HealthTemplate, "health-template", "",
+		"file with a Go text/template for health and liveness response bodies",
+	)
+	flag.BoolVar(&config.GRPCHealth, "grpc-health", false,
+		"serve grpc.health.v1.Health on the listen address (services \"\" and \"liveness\")",
+	)
+	flag.StringVar(&config.EchoParams, "echo-params", "",
+		"comma separated query parameters of scrapes that are added as labels to all series, e.g. module",
+	)
 	flag.StringVar(&config.Namespace, "namespace", "",
 		"prometheus namespace",
 	)
 	flag.StringVar(&config.Subsystem, "subsystem", "",
 		"prometheus subsystem",
 	)
+	flag.StringVar(&config.ErrorReportDSN, "error-report-dsn", "",
+		"report panics and backend and watcher errors to the Sentry compatible error tracker with this DSN",
+	)
+	flag.StringVar(&config.StateFile, "state-file", "",
+		"persist counters and the last run of each job in this file across restarts",
+	)
+	flag.StringVar(&config.TimeSource, "time-source", exporter.TimeSourceSystem,
+		"clock that ages are computed against: \"system\", \"monotonic\" since startup or the system clock corrected by \"ntp\"",
+	)
+	flag.StringVar(&config.NTPServer, "ntp-server", "pool.ntp.org",
+		"NTP server to check the system clock against, if -time-source is ntp",
+	)
+	flag.DurationVar(&config.NTPInterval, "ntp-interval", 5*time.Minute,
+		"how often to check the system clock against the NTP server",
+	)
 	flag.DurationVar(&config.HealthTimeout, "health-timeout", 10*time.Minute,
 		"when should the service be considered unhealthy",
 	)
@@ -84,21 +308,116 @@ func configure(log *logrus.Logger) *exporter.Config {
 	flag.DurationVar(&config.Welpenschutz, "health-welpenschutz", 10*time.Minute,
 		"how long initially the service is considered healthy.",
 	)
+	flag.StringVar(&config.WelpenschutzMode, "health-welpenschutz-mode", exporter.WelpenschutzDuration,
+		"what ends the welpenschutz: \"duration\" after startup, the first \"update\" run, when the end file first \"exists\", or \"duration\" only if the end file is \"missing\"",
+	)
 	flag.DurationVar(&config.DirectoryTimeout, "directory-timeout", 10*time.Minute,
 		"how long to wait for missing directories",
 	)
+	flag.BoolVar(&config.AllowMissingTargets, "allow-missing-targets", false,
+		"serve right away if directories are missing and watch them once they appear, instead of exiting after -directory-timeout",
+	)
+	flag.DurationVar(&config.PollInterval, "poll-interval", 0,
+		"watch the directories by listing them this often instead of by fs notifications (0 uses fs notifications)",
+	)
+	flag.DurationVar(&config.DirectoryRetry.Backoff, "directory-retry-backoff", time.Second,
+		"initial delay between attempts to watch a missing directory, doubled on each retry",
+	)
+	flag.DurationVar(&config.DirectoryRetry.MaxBackoff, "directory-retry-max-backoff", 0,
+		"maximum delay between attempts to watch a missing directory (0 means unlimited)",
+	)
+	flag.IntVar(&config.DirectoryRetry.MaxAttempts, "directory-retry-max-attempts", 0,
+		"give up watching a missing directory after this many retries (0 means unlimited)",
+	)
+	flag.Float64Var(&config.DirectoryRetry.Jitter, "directory-retry-jitter", 0,
+		"randomize delays between attempts to watch a missing directory by this fraction",
+	)
+	flag.DurationVar(&config.MinDuration, "duration-min", 0,
+		"update runs shorter than this are counted as implausible instead of observed (0 disables)",
+	)
+	flag.DurationVar(&config.MaxDuration, "duration-max", 0,
+		"update runs longer than this are counted as implausible instead of observed (0 disables)",
+	)
+	flag.Var(&config.DurationObjectives, "duration-objectives",
+		"comma separated quantile:error pairs of the update_duration_seconds summary, e.g. 0.5:0.05,0.99:0.001",
+	)
+	flag.DurationVar(&config.DurationMaxAge, "duration-max-age", 10*time.Minute,
+		"sliding window of the quantiles of -duration-objectives",
+	)
+	flag.BoolVar(&config.DurationHistogram, "duration-histogram", false,
+		"export update_duration_seconds as a histogram, which can be aggregated across instances, instead of a summary",
+	)
+	flag.Var(&config.DurationBuckets, "duration-buckets",
+		"comma separated upper bounds of the buckets of -duration-histogram, e.g. 1m,10m,1h (default exponential from 1s to about 36h)",
+	)
+	flag.Float64Var(&config.DurationNativeFactor, "duration-native-histogram-factor", 0,
+		"also export -duration-histogram as a native histogram with this growth factor between buckets, e.g. 1.1 (0 disables)",
+	)
+	flag.StringVar(&config.DirectoryRemoved, "directory-removed", exporter.DirectoryRemovedError,
+		"how a job is reported right away once the directory of its files vanished: unhealthy as \"error\" with state unknown, or as \"stale\"",
+	)
+	flag.StringVar(&config.DurationSource, "duration-source", exporter.DurationMtime,
+		"how update runs are timed: by the \"mtime\" of the start and end file or by when their fs \"events\" were observed",
+	)
+	flag.DurationVar(&config.SyntheticInterval, "synthetic-interval", 0,
+		"simulate update runs by touching the start and end file; a run starts this often (0 disables)",
+	)
+	flag.DurationVar(&config.SyntheticDuration, "synthetic-duration", 0,
+		"how long simulated update runs take, see -synthetic-interval",
+	)
+	flag.Int64Var(&config.CountRowsMaxSize, "count-rows-max-size", 0,
+		"count the lines of the end file when it changes, if it has at most this many bytes (0 disables)",
+	)
+	flag.DurationVar(&config.RescanInterval, "rescan-interval", 0,
+		"re-measure the files this often in case fs events got lost, spread out to avoid IO spikes (0 disables)",
+	)
+	flag.DurationVar(&config.RunCheckpoint, "run-checkpoint", 0,
+		"log and notify that an update run is still running each time it has been running this much longer (0 disables)",
+	)
+	flag.StringVar(&config.Tenant, "tenant", "",
+		"serve the metrics of the job only at -tenant-metrics under this name instead of -prom",
+	)
+	flag.IntVar(&config.StrictAnomalies, "strict-anomalies", 0,
+		"report unhealthy after this many anomalies without a regular update in between (0 disables)",
+	)
+	flag.Var(&config.Annotations, "annotation",
+		"key=value metadata about the monitored process, e.g. runbook=https://...; may be repeated",
+	)
+	flag.Var(&config.Phases, "phase",
+		"name=file of a marker file touched when a phase of a run has completed; may be repeated in phase order",
+	)
 	flag.BoolVar(&config.Debug, "debug", true,
 		"enable debug logging (enabled by default)",
 	)
 	flag.BoolVar(&config.LogJSON, "log-json", false,
 		"enable JSON-formatted logging",
 	)
-	flag.Parse()
+	lowResource := flag.Bool("low-resource", false,
+		"profile for small devices: drop the go and process metrics, keep smaller buffers and poll every 1m unless -poll-interval is set",
+	)
+	version := flag.Bool("version", false,
+		"print version information and exit",
+	)
+	setFlagsFromEnv(log)
+	_ = flag.CommandLine.Parse(args) // exits on error
+
+	if *version {
+		v, revision, goVersion := exporter.BuildInfo()
+		if v == "" {
+			v = "unknown"
+		}
+		fmt.Printf("prometheus_fileage_exporter %s (revision %s, %s)\n", v, revision, goVersion)
+		os.Exit(0)
+	}
 
 	if config.LogJSON {
 		log.Formatter = new(logrus.JSONFormatter)
 	}
 
+	if *lowResource {
+		configureLowResource(config)
+	}
+
 	if flag.NArg() != 0 {
 		log.Fatalf("Superfluous arguments: %v", flag.Args())
 	}
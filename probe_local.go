@@ -0,0 +1,56 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// probeLocal implements the probe-local subcommand. It is meant to be run as
+// a kubernetes exec probe in the container sharing the timestamp file and
+// returns the process exit code: 0 if the file is younger than -max-age, 1
+// otherwise and 2 on usage errors.
+func probeLocal(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("probe-local", flag.ContinueOnError)
+	fs.SetOutput(out)
+	file := fs.String("file", "", "the timestamp file to check")
+	maxAge := fs.Duration("max-age", 10*time.Minute, "maximum age of the file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	stat, err := os.Stat(*file)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "FAIL %s: %v\n", *file, err)
+		return 1
+	}
+	age := time.Since(stat.ModTime())
+	// Rounded for display only, to keep sub-second limits exact.
+	shown := age.Round(time.Millisecond)
+	if age >= *maxAge {
+		_, _ = fmt.Fprintf(out, "FAIL %s: age %s >= %s\n", *file, shown, *maxAge)
+		return 1
+	}
+	_, _ = fmt.Fprintf(out, "OK %s: age %s < %s\n", *file, shown, *maxAge)
+	return 0
+}
@@ -0,0 +1,179 @@
+//   Copyright 2019 Johannes Kohnen
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/jwkohnen/prometheus_fileage_exporter/exporter"
+)
+
+// serviceName is the name of the Windows service and its event log source.
+const serviceName = "fileage_exporter"
+
+// serviceCommand runs the subcommands for managing the Windows service:
+//
+//	install [flags]  registers the service to run with the given flags
+//	uninstall        removes the service
+//	run [flags]      is what the service control manager starts
+//
+// It reports whether cmd was one of them.
+func serviceCommand(log *logrus.Logger, cmd string, args []string) bool {
+	switch cmd {
+	case "install":
+		// Refuse to install a service that would fail to start.
+		configure(log, args)
+		if err := installService(args); err != nil {
+			log.Fatalf("Error installing service: %v", err)
+		}
+		log.Infof("Installed service %s", serviceName)
+	case "uninstall":
+		if err := uninstallService(); err != nil {
+			log.Fatalf("Error removing service: %v", err)
+		}
+		log.Infof("Removed service %s", serviceName)
+	case "run":
+		elog, err := eventlog.Open(serviceName)
+		if err != nil {
+			log.Fatalf("Error opening event log: %v", err)
+		}
+		defer elog.Close()
+		log.AddHook(eventlogHook{elog})
+		cfg := configure(log, args)
+		if err := svc.Run(serviceName, &service{log: log, cfg: cfg}); err != nil {
+			log.Fatalf("Error running service: %v", err)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Prometheus fileage exporter",
+		Description: "Exports the age of timestamp files to Prometheus.",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"run"}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		_ = s.Delete()
+		return fmt.Errorf("registering event log source: %w", err)
+	}
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+// service handles requests of the service control manager.
+type service struct {
+	log *logrus.Logger
+	cfg *exporter.Config
+}
+
+func (s *service) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(s.log, s.cfg, stop)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s.log.Infof("Received %s request, shutting down", map[svc.Cmd]string{svc.Stop: "stop", svc.Shutdown: "shutdown"}[c.Cmd])
+				changes <- svc.Status{State: svc.StopPending}
+				close(stop)
+				<-done
+				return false, 0
+			}
+		case <-done:
+			// serve only returns early if the server failed.
+			return false, 1
+		}
+	}
+}
+
+// eventlogHook writes log entries to the Windows event log, as the stderr
+// of a service goes nowhere.
+type eventlogHook struct {
+	elog *eventlog.Log
+}
+
+func (h eventlogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h eventlogHook) Fire(e *logrus.Entry) error {
+	msg, err := e.String()
+	if err != nil {
+		return err
+	}
+	switch e.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return h.elog.Error(1, msg)
+	case logrus.WarnLevel:
+		return h.elog.Warning(1, msg)
+	default:
+		return h.elog.Info(1, msg)
+	}
+}